@@ -0,0 +1,112 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/internal/mq"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var errReplayLimit = errors.New("replay limit reached")
+
+func NewDLQCmd() *cobra.Command {
+	dlqCmd := &cobra.Command{
+		Use:   "dlq",
+		Short: "Manage the dead letter topic",
+		Long:  "Inspect and replay messages that could not be delivered to lark",
+	}
+	dlqCmd.AddCommand(newDLQReplayCmd())
+	return dlqCmd
+}
+
+func newDLQReplayCmd() *cobra.Command {
+	var (
+		partition int
+		offsets   []int64
+		stage     string
+		chatID    string
+		limit     int
+		dryRun    bool
+	)
+	replayCmd := &cobra.Command{
+		Use:   "replay",
+		Short: "Re-inject dead letters into the main topic",
+		Long: `Re-inject the selected messages of kafka.dlqTopic into kafka.topic.
+A replayed delivery failure is only delivered to the chat that failed.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if config.GlobalConfig.Kafka.DLQTopic == "" {
+				return fmt.Errorf("kafka.dlqTopic is not configured")
+			}
+			if len(config.GlobalConfig.Kafka.Brokers) == 0 || config.GlobalConfig.Kafka.Topic == "" {
+				return fmt.Errorf("invalid kafka config")
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+
+			producer, err := mq.NewKafkaProducer(config.GlobalConfig.Kafka.Topic)
+			if err != nil {
+				return err
+			}
+			defer producer.Close()
+
+			replayed := 0
+			err = mq.ReadDLQ(ctx, func(m mq.Message) error {
+				if partition >= 0 && m.Partition != partition {
+					return nil
+				}
+				if len(offsets) > 0 && !slices.Contains(offsets, m.Offset) {
+					return nil
+				}
+				if stage != "" && mq.HeaderValue(m, mq.HeaderDLQStage) != stage {
+					return nil
+				}
+				if chatID != "" && mq.HeaderValue(m, mq.HeaderChatID) != chatID {
+					return nil
+				}
+				if limit > 0 && replayed >= limit {
+					return errReplayLimit
+				}
+
+				log.Info().Msgf("replay dead letter %d/%d, stage: %s, chat: %s, attempts: %s, error: %s",
+					m.Partition, m.Offset,
+					mq.HeaderValue(m, mq.HeaderDLQStage),
+					mq.HeaderValue(m, mq.HeaderChatID),
+					mq.HeaderValue(m, mq.HeaderDLQAttempts),
+					mq.HeaderValue(m, mq.HeaderDLQError))
+				replayed++
+				if dryRun {
+					return nil
+				}
+				return producer.Produce(ctx, mq.Message{
+					Key:     m.Key,
+					Value:   m.Value,
+					Headers: mq.StripDLQHeaders(m.Headers),
+				})
+			})
+			if err != nil && !errors.Is(err, errReplayLimit) {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "replayed %d dead letters\n", replayed)
+			return nil
+		},
+	}
+
+	flags := replayCmd.Flags()
+	flags.IntVar(&partition, "partition", -1, "only replay dead letters of this dlq partition, -1 replays all partitions")
+	flags.Int64SliceVar(&offsets, "offset", nil, "only replay dead letters at these dlq offsets")
+	flags.StringVar(&stage, "stage", "", "only replay dead letters of this stage, decode or deliver")
+	flags.StringVar(&chatID, "chat-id", "", "only replay dead letters of this chat")
+	flags.IntVar(&limit, "limit", 0, "replay at most this many dead letters, 0 means no limit")
+	flags.BoolVar(&dryRun, "dry-run", false, "list the selected dead letters without replaying them")
+	return replayCmd
+}
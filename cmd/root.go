@@ -33,20 +33,16 @@ func NewRootCmd() *cobra.Command {
 			}
 			c, _ := json.Marshal(config.GlobalConfig)
 			log.Info().Msg(string(c))
-			if len(config.GlobalConfig.Kafka.Brokers) == 0 || config.GlobalConfig.Kafka.Topic == "" {
-				return fmt.Errorf("invalid kafka config")
-			}
-			if config.GlobalConfig.Lark.AppID == "" || config.GlobalConfig.Lark.AppSecret == "" || config.GlobalConfig.Lark.ChatID == "" {
-				return fmt.Errorf("invalid lark config")
-			}
 			return nil
 		},
 	}
 
 	rootCmd.SetVersionTemplate("0.0.2")
+	installKafkaFlags(rootCmd.PersistentFlags())
 
 	rootCmd.AddCommand(
 		NewServerCmd(),
+		NewDLQCmd(),
 	)
 	return rootCmd
 }
@@ -4,9 +4,20 @@ Copyright © 2025 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
 	"github.com/404LifeFound/alertmanager-lark/internal/alert"
+	"github.com/404LifeFound/alertmanager-lark/internal/alertmanager"
+	"github.com/404LifeFound/alertmanager-lark/internal/health"
 	"github.com/404LifeFound/alertmanager-lark/internal/mq"
+	"github.com/404LifeFound/alertmanager-lark/internal/policy"
+	"github.com/404LifeFound/alertmanager-lark/internal/route"
 	"github.com/404LifeFound/alertmanager-lark/internal/server"
+	"github.com/404LifeFound/alertmanager-lark/internal/state"
+	"github.com/404LifeFound/alertmanager-lark/internal/tracing"
 	"github.com/404LifeFound/alertmanager-lark/internal/worker"
 	"github.com/ipfans/fxlogger"
 	"github.com/rs/zerolog/log"
@@ -21,18 +32,34 @@ func NewServerCmd() *cobra.Command {
 		Use:   "server",
 		Short: "Start http server",
 		Long:  "Start a http server for webhook",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return validateServerConfig()
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 			app := fx.New(
 				fx.Provide(
+					health.NewRegistry,
 					server.NewGinEngine,
-					mq.NewKafkaReader,
-					mq.NewKafkaWriter,
+					mq.NewQueue,
+					mq.NewSpool,
+					mq.NewDLQ,
 					alert.NewLark,
+					alert.NewTemplates,
+					alertmanager.NewClient,
+					policy.NewPolicy,
+					state.NewStore,
+					route.NewTree,
+					route.NewReceivers,
 				),
 				fx.Invoke(
+					tracing.Setup,
 					server.RegisterHandlers,
 					worker.Run,
+					// started last and stopped first, so nothing is accepted
+					// while the deliveries drain
+					server.Serve,
 				),
+				fx.StopTimeout(shutdownTimeout()),
 				fx.WithLogger(fxlogger.WithZerolog(log.Logger)),
 			)
 			app.Run()
@@ -44,6 +71,71 @@ func NewServerCmd() *cobra.Command {
 	return serverCmd
 }
 
+// validateServerConfig checks the config the server needs, the other
+// commands only use parts of it.
+func validateServerConfig() error {
+	switch config.GlobalConfig.Delivery.Mode {
+	case "", mq.DeliveryQueue:
+		switch config.GlobalConfig.Queue.Backend {
+		case "", mq.BackendKafka:
+			if len(config.GlobalConfig.Kafka.Brokers) == 0 || config.GlobalConfig.Kafka.Topic == "" ||
+				config.GlobalConfig.Kafka.ConsumerGroup == "" {
+				return fmt.Errorf("invalid kafka config")
+			}
+		case mq.BackendMemory:
+		case mq.BackendWAL:
+			if config.GlobalConfig.Queue.WAL.Path == "" {
+				return fmt.Errorf("invalid wal queue config")
+			}
+		case mq.BackendRedis:
+			if len(config.GlobalConfig.Queue.Redis.Addrs) == 0 || config.GlobalConfig.Queue.Redis.Stream == "" ||
+				config.GlobalConfig.Queue.Redis.Group == "" {
+				return fmt.Errorf("invalid redis queue config")
+			}
+		default:
+			return fmt.Errorf("invalid queue backend %s, valid backends: %s", config.GlobalConfig.Queue.Backend, strings.Join(mq.Backends, ", "))
+		}
+	case mq.DeliveryDirect:
+	default:
+		return fmt.Errorf("invalid delivery mode %s", config.GlobalConfig.Delivery.Mode)
+	}
+	if config.GlobalConfig.Lark.AppID == "" || config.GlobalConfig.Lark.AppSecret == "" {
+		return fmt.Errorf("invalid lark config")
+	}
+	if config.GlobalConfig.Lark.ChatID == "" && len(config.GlobalConfig.Route.ChatIDs) == 0 {
+		return fmt.Errorf("invalid lark config")
+	}
+	// every card carries action buttons, their callbacks are verified with
+	// the encrypt key
+	if config.GlobalConfig.Lark.EncryptKey == "" {
+		return fmt.Errorf("lark encryptKey is required to verify card callbacks")
+	}
+	switch config.GlobalConfig.Tracing.Exporter {
+	case "", tracing.ExporterStdout:
+	case tracing.ExporterOTLP:
+		switch config.GlobalConfig.Tracing.Protocol {
+		case "", tracing.ProtocolHTTP, tracing.ProtocolGRPC:
+		default:
+			return fmt.Errorf("invalid tracing protocol %s", config.GlobalConfig.Tracing.Protocol)
+		}
+	default:
+		return fmt.Errorf("invalid tracing exporter %s", config.GlobalConfig.Tracing.Exporter)
+	}
+	switch config.GlobalConfig.Card.Mode {
+	case "", alert.ModeAlert, alert.ModeGrouped:
+	default:
+		return fmt.Errorf("invalid card mode %s", config.GlobalConfig.Card.Mode)
+	}
+	return nil
+}
+
+func shutdownTimeout() time.Duration {
+	if config.GlobalConfig.ShutdownTimeoutSeconds <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(config.GlobalConfig.ShutdownTimeoutSeconds) * time.Second
+}
+
 func installFlags(flags *pflag.FlagSet) {
 	log.Debug().Msg("start to install server flags")
 	flags.StringP("http-host", "H", "0.0.0.0", "http host")
@@ -52,23 +144,122 @@ func installFlags(flags *pflag.FlagSet) {
 	flags.IntP("http-port", "P", 8080, "http port")
 	viper.BindPFlag("http.port", flags.Lookup("http-port"))
 
-	flags.StringSlice("kafka-brokers", []string{"localhost:9092"}, "kafka brokers list")
-	viper.BindPFlag("kafka.brokers", flags.Lookup("kafka-brokers"))
+	flags.String("http-tls-cert-file", "", "serve https with this certificate")
+	viper.BindPFlag("http.tls.certFile", flags.Lookup("http-tls-cert-file"))
 
-	flags.String("kafka-topic", "webhook-topic", "kafka topic")
-	viper.BindPFlag("kafka.topic", flags.Lookup("kafka-topic"))
+	flags.String("http-tls-key-file", "", "key of the https certificate")
+	viper.BindPFlag("http.tls.keyFile", flags.Lookup("http-tls-key-file"))
 
-	flags.String("kafka-consumer-group", "webhook-consumer", "kafka consumer group ID")
-	viper.BindPFlag("kafka.consumerGroup", flags.Lookup("kafka-consumer-group"))
+	flags.String("http-tls-client-ca-file", "", "ca verifying the client certificates of webhooks")
+	viper.BindPFlag("http.tls.clientCAFile", flags.Lookup("http-tls-client-ca-file"))
 
-	flags.Int("kafka-max-bytes", 10e6, "Max size of kafka message produce or consume(bytes)")
-	viper.BindPFlag("kafka.maxBytes", flags.Lookup("kafka-max-bytes"))
+	flags.StringSlice("webhook-bearer-tokens", nil, "bearer tokens accepted on the webhook, several allow rotation")
+	viper.BindPFlag("webhook.auth.bearerTokens", flags.Lookup("webhook-bearer-tokens"))
 
-	flags.Int("kafka-write-retries", 3, "kafka write retries on failure")
-	viper.BindPFlag("kafka.writeRetries", flags.Lookup("kafka-write-retries"))
+	flags.StringSlice("webhook-hmac-secrets", nil, "secrets accepted for hmac signed webhooks")
+	viper.BindPFlag("webhook.auth.hmac.secrets", flags.Lookup("webhook-hmac-secrets"))
 
-	flags.Int("kafka-write-retry-backoff-ms", 500, "kafka write retry backoff in milliseconds")
-	viper.BindPFlag("kafka.writeRetryBackoffMs", flags.Lookup("kafka-write-retry-backoff-ms"))
+	flags.Bool("webhook-client-cert-required", false, "require a client certificate verified against the http client ca on the webhook")
+	viper.BindPFlag("webhook.auth.clientCert.required", flags.Lookup("webhook-client-cert-required"))
+
+	flags.String("queue-backend", "kafka", "queue between webhook and delivery, one of kafka, memory, wal, redis")
+	viper.BindPFlag("queue.backend", flags.Lookup("queue-backend"))
+
+	flags.Bool("queue-fan-out", false, "write every alert of a notification as its own record keyed by fingerprint")
+	viper.BindPFlag("queue.fanOut", flags.Lookup("queue-fan-out"))
+
+	flags.Bool("queue-envelope", true, "wrap records in a versioned envelope with ingestion metadata")
+	viper.BindPFlag("queue.envelope", flags.Lookup("queue-envelope"))
+
+	flags.Int("queue-memory-size", 1000, "number of messages the memory queue holds")
+	viper.BindPFlag("queue.memorySize", flags.Lookup("queue-memory-size"))
+
+	flags.String("queue-wal-path", "./data/queue", "directory of the wal queue")
+	viper.BindPFlag("queue.wal.path", flags.Lookup("queue-wal-path"))
+
+	flags.Int64("queue-wal-segment-bytes", 64<<20, "size a wal queue segment is rolled at")
+	viper.BindPFlag("queue.wal.segmentBytes", flags.Lookup("queue-wal-segment-bytes"))
+
+	flags.Bool("queue-spool-enabled", false, "spool webhooks on disk while the queue can't be written to")
+	viper.BindPFlag("queue.spool.enabled", flags.Lookup("queue-spool-enabled"))
+
+	flags.String("queue-spool-path", "./data/spool", "directory of the spool")
+	viper.BindPFlag("queue.spool.path", flags.Lookup("queue-spool-path"))
+
+	flags.Int64("queue-spool-max-bytes", 1<<30, "size the spool rejects webhooks at, 0 means no limit")
+	viper.BindPFlag("queue.spool.maxBytes", flags.Lookup("queue-spool-max-bytes"))
+
+	flags.Int64("queue-spool-segment-bytes", 16<<20, "size a spool segment is rolled at")
+	viper.BindPFlag("queue.spool.segmentBytes", flags.Lookup("queue-spool-segment-bytes"))
+
+	flags.StringSlice("queue-redis-addrs", []string{"localhost:6379"}, "redis addresses of the redis queue")
+	viper.BindPFlag("queue.redis.addrs", flags.Lookup("queue-redis-addrs"))
+
+	flags.String("queue-redis-username", "", "redis username of the redis queue")
+	viper.BindPFlag("queue.redis.username", flags.Lookup("queue-redis-username"))
+
+	flags.String("queue-redis-password", "", "redis password of the redis queue")
+	viper.BindPFlag("queue.redis.password", flags.Lookup("queue-redis-password"))
+
+	flags.Int("queue-redis-db", 0, "redis database of the redis queue")
+	viper.BindPFlag("queue.redis.db", flags.Lookup("queue-redis-db"))
+
+	flags.String("queue-redis-stream", "alertmanager-lark", "redis stream of the redis queue")
+	viper.BindPFlag("queue.redis.stream", flags.Lookup("queue-redis-stream"))
+
+	flags.String("queue-redis-group", "alertmanager-lark", "consumer group reading the redis stream")
+	viper.BindPFlag("queue.redis.group", flags.Lookup("queue-redis-group"))
+
+	flags.String("queue-redis-consumer", "", "consumer name in the redis group, defaults to the hostname")
+	viper.BindPFlag("queue.redis.consumer", flags.Lookup("queue-redis-consumer"))
+
+	flags.Int64("queue-redis-max-len", 100000, "approximate number of entries the redis stream is trimmed to, 0 disables trimming")
+	viper.BindPFlag("queue.redis.maxLen", flags.Lookup("queue-redis-max-len"))
+
+	flags.Int("queue-redis-claim-idle-seconds", 300, "claim entries pending on another consumer for this many seconds")
+	viper.BindPFlag("queue.redis.claimIdleSeconds", flags.Lookup("queue-redis-claim-idle-seconds"))
+
+	flags.String("delivery-mode", "queue", "queue delivers through the queue backend, direct hands webhooks to the workers in process")
+	viper.BindPFlag("delivery.mode", flags.Lookup("delivery-mode"))
+
+	flags.Int("delivery-queue-size", 1000, "notifications pending in direct mode before webhooks are rejected with 503")
+	viper.BindPFlag("delivery.queueSize", flags.Lookup("delivery-queue-size"))
+
+	flags.Int("delivery-workers", 8, "number of workers delivering messages in parallel, ordered per notification group")
+	viper.BindPFlag("delivery.workers", flags.Lookup("delivery-workers"))
+
+	flags.Int("delivery-max-in-flight", 100, "max number of fetched messages not delivered yet")
+	viper.BindPFlag("delivery.maxInFlight", flags.Lookup("delivery-max-in-flight"))
+
+	flags.Int("shutdown-timeout-seconds", 30, "seconds in-flight deliveries and card actions are waited for on shutdown")
+	viper.BindPFlag("shutdownTimeoutSeconds", flags.Lookup("shutdown-timeout-seconds"))
+
+	flags.Int("health-timeout-seconds", 5, "timeout of a single readiness check")
+	viper.BindPFlag("health.timeoutSeconds", flags.Lookup("health-timeout-seconds"))
+
+	flags.Int("health-cache-seconds", 10, "seconds a readiness report is served from cache")
+	viper.BindPFlag("health.cacheSeconds", flags.Lookup("health-cache-seconds"))
+
+	flags.Int("health-stuck-seconds", 300, "seconds a delivery attempt may take before the worker is reported stuck")
+	viper.BindPFlag("health.stuckSeconds", flags.Lookup("health-stuck-seconds"))
+
+	flags.String("tracing-exporter", "", "trace exporter, otlp or stdout, empty disables tracing")
+	viper.BindPFlag("tracing.exporter", flags.Lookup("tracing-exporter"))
+
+	flags.String("tracing-endpoint", "localhost:4318", "host:port of the otlp collector")
+	viper.BindPFlag("tracing.endpoint", flags.Lookup("tracing-endpoint"))
+
+	flags.String("tracing-protocol", "http", "otlp protocol, http or grpc")
+	viper.BindPFlag("tracing.protocol", flags.Lookup("tracing-protocol"))
+
+	flags.Bool("tracing-insecure", true, "export to the otlp collector without tls")
+	viper.BindPFlag("tracing.insecure", flags.Lookup("tracing-insecure"))
+
+	flags.Float64("tracing-sample-ratio", 1, "ratio of new traces sampled, traces started upstream follow their parent")
+	viper.BindPFlag("tracing.sampleRatio", flags.Lookup("tracing-sample-ratio"))
+
+	flags.String("tracing-service-name", "alertmanager-lark", "service name of the spans")
+	viper.BindPFlag("tracing.serviceName", flags.Lookup("tracing-service-name"))
 
 	flags.String("lark-app-id", "", "lark appID")
 	viper.BindPFlag("lark.appID", flags.Lookup("lark-app-id"))
@@ -79,7 +270,7 @@ func installFlags(flags *pflag.FlagSet) {
 	flags.String("lark-chat-id", "", "lark chatID")
 	viper.BindPFlag("lark.chatID", flags.Lookup("lark-chat-id"))
 
-	flags.String("lark-encrypt-key", "", "lark callback encrypt key")
+	flags.String("lark-encrypt-key", "", "lark callback encrypt key, required to verify card callbacks")
 	viper.BindPFlag("lark.encryptKey", flags.Lookup("lark-encrypt-key"))
 
 	flags.String("lark-verification-token", "", "lark callback veritication token")
@@ -91,6 +282,48 @@ func installFlags(flags *pflag.FlagSet) {
 	flags.Int("lark-send-retry-backoff-ms", 500, "lark send retry backoff in milliseconds")
 	viper.BindPFlag("lark.sendRetryBackoffMs", flags.Lookup("lark-send-retry-backoff-ms"))
 
+	flags.IntSlice("lark-permanent-error-codes", nil, "lark api error codes cards are not sent again on, defaults to invalid chat, bot not in chat, permission and deleted message errors")
+	viper.BindPFlag("lark.permanentErrorCodes", flags.Lookup("lark-permanent-error-codes"))
+
+	flags.String("card-mode", "alert", "card mode, alert posts one card per alert, grouped one card per notification group")
+	viper.BindPFlag("card.mode", flags.Lookup("card-mode"))
+
+	flags.Int("card-grouped-max-alerts", 10, "alerts listed on a grouped card before the rest is collapsed")
+	viper.BindPFlag("card.groupedMaxAlerts", flags.Lookup("card-grouped-max-alerts"))
+
+	flags.StringSlice("alertmanager-urls", nil, "alertmanager urls used to create silences from cards")
+	viper.BindPFlag("alertmanager.urls", flags.Lookup("alertmanager-urls"))
+
+	flags.String("alertmanager-bearer-token", "", "bearer token for the alertmanager api")
+	viper.BindPFlag("alertmanager.bearerToken", flags.Lookup("alertmanager-bearer-token"))
+
+	flags.String("alertmanager-username", "", "basic auth username for the alertmanager api")
+	viper.BindPFlag("alertmanager.username", flags.Lookup("alertmanager-username"))
+
+	flags.String("alertmanager-password", "", "basic auth password for the alertmanager api")
+	viper.BindPFlag("alertmanager.password", flags.Lookup("alertmanager-password"))
+
+	flags.Int("alertmanager-timeout-ms", 10000, "alertmanager api timeout in milliseconds")
+	viper.BindPFlag("alertmanager.timeoutMs", flags.Lookup("alertmanager-timeout-ms"))
+
+	flags.Bool("state-enabled", false, "persist the card state on disk, otherwise it is kept in memory and lost on restart")
+	viper.BindPFlag("state.enabled", flags.Lookup("state-enabled"))
+
+	flags.String("state-path", "./data/state.db", "path of the state database file")
+	viper.BindPFlag("state.path", flags.Lookup("state-path"))
+
+	flags.Int("state-ttl-hours", 168, "remove state entries not updated for this many hours, 0 disables cleanup")
+	viper.BindPFlag("state.ttlHours", flags.Lookup("state-ttl-hours"))
+
+	flags.Int("state-cleanup-interval-minutes", 60, "interval between state cleanups in minutes")
+	viper.BindPFlag("state.cleanupIntervalMinutes", flags.Lookup("state-cleanup-interval-minutes"))
+
+	flags.Int("lark-callback-max-skew-seconds", 300, "reject card callbacks whose timestamp is older or newer than this many seconds")
+	viper.BindPFlag("lark.callbackMaxSkewSeconds", flags.Lookup("lark-callback-max-skew-seconds"))
+
+	flags.Int("lark-callback-nonce-cache-size", 10000, "number of card callback nonces remembered to reject replays")
+	viper.BindPFlag("lark.callbackNonceCacheSize", flags.Lookup("lark-callback-nonce-cache-size"))
+
 	flags.StringSlice("alert-fields-alert-name-keys", []string{"alertname"}, "Keys to search for alert name")
 	viper.BindPFlag("alertFields.alertNameKeys", flags.Lookup("alert-fields-alert-name-keys"))
 
@@ -108,4 +341,83 @@ func installFlags(flags *pflag.FlagSet) {
 
 	flags.StringSlice("alert-fields-description-keys", []string{"description", "summary", "message"}, "Keys to search for description")
 	viper.BindPFlag("alertFields.descriptionKeys", flags.Lookup("alert-fields-description-keys"))
+
+	flags.StringSlice("alert-fields-template-keys", []string{"lark_template"}, "Keys to search for card template name")
+	viper.BindPFlag("alertFields.templateKeys", flags.Lookup("alert-fields-template-keys"))
+}
+
+// installKafkaFlags adds the kafka flags shared by the server and the dlq
+// commands.
+func installKafkaFlags(flags *pflag.FlagSet) {
+	flags.StringSlice("kafka-brokers", []string{"localhost:9092"}, "kafka brokers list")
+	viper.BindPFlag("kafka.brokers", flags.Lookup("kafka-brokers"))
+
+	flags.String("kafka-topic", "webhook-topic", "kafka topic")
+	viper.BindPFlag("kafka.topic", flags.Lookup("kafka-topic"))
+
+	flags.String("kafka-consumer-group", "webhook-consumer", "kafka consumer group ID")
+	viper.BindPFlag("kafka.consumerGroup", flags.Lookup("kafka-consumer-group"))
+
+	flags.Int("kafka-max-bytes", 10e6, "Max size of kafka message produce or consume(bytes)")
+	viper.BindPFlag("kafka.maxBytes", flags.Lookup("kafka-max-bytes"))
+
+	flags.Int("kafka-write-retries", 3, "kafka write retries on failure")
+	viper.BindPFlag("kafka.writeRetries", flags.Lookup("kafka-write-retries"))
+
+	flags.Int("kafka-write-retry-backoff-ms", 500, "kafka write retry backoff in milliseconds")
+	viper.BindPFlag("kafka.writeRetryBackoffMs", flags.Lookup("kafka-write-retry-backoff-ms"))
+
+	flags.String("kafka-dlq-topic", "", "kafka topic receiving messages that can't be delivered, empty disables dead-lettering")
+	viper.BindPFlag("kafka.dlqTopic", flags.Lookup("kafka-dlq-topic"))
+
+	flags.Int("kafka-max-delivery-attempts", 5, "delivery attempts of a message before it is dead-lettered, or dropped without a dlq topic, 0 retries forever")
+	viper.BindPFlag("kafka.maxDeliveryAttempts", flags.Lookup("kafka-max-delivery-attempts"))
+
+	flags.Bool("kafka-tls-enabled", false, "connect to kafka brokers over tls")
+	viper.BindPFlag("kafka.tls.enabled", flags.Lookup("kafka-tls-enabled"))
+
+	flags.String("kafka-tls-ca-file", "", "ca certificate file verifying the kafka brokers")
+	viper.BindPFlag("kafka.tls.caFile", flags.Lookup("kafka-tls-ca-file"))
+
+	flags.String("kafka-tls-cert-file", "", "client certificate file for kafka")
+	viper.BindPFlag("kafka.tls.certFile", flags.Lookup("kafka-tls-cert-file"))
+
+	flags.String("kafka-tls-key-file", "", "client key file for kafka")
+	viper.BindPFlag("kafka.tls.keyFile", flags.Lookup("kafka-tls-key-file"))
+
+	flags.Bool("kafka-tls-insecure-skip-verify", false, "skip verifying the kafka broker certificates")
+	viper.BindPFlag("kafka.tls.insecureSkipVerify", flags.Lookup("kafka-tls-insecure-skip-verify"))
+
+	flags.String("kafka-sasl-mechanism", "", "kafka sasl mechanism, one of plain, scram-sha-256, scram-sha-512")
+	viper.BindPFlag("kafka.sasl.mechanism", flags.Lookup("kafka-sasl-mechanism"))
+
+	flags.String("kafka-sasl-username", "", "kafka sasl username")
+	viper.BindPFlag("kafka.sasl.username", flags.Lookup("kafka-sasl-username"))
+
+	flags.String("kafka-sasl-password", "", "kafka sasl password")
+	viper.BindPFlag("kafka.sasl.password", flags.Lookup("kafka-sasl-password"))
+
+	flags.String("kafka-compression", "none", "kafka producer compression, one of none, gzip, snappy, lz4, zstd")
+	viper.BindPFlag("kafka.compression", flags.Lookup("kafka-compression"))
+
+	flags.Int("kafka-required-acks", 1, "acks the kafka producer waits for, -1 all, 1 leader, 0 none")
+	viper.BindPFlag("kafka.requiredAcks", flags.Lookup("kafka-required-acks"))
+
+	flags.Int("kafka-batch-size", 100, "max number of messages in a kafka producer batch")
+	viper.BindPFlag("kafka.batchSize", flags.Lookup("kafka-batch-size"))
+
+	flags.Int("kafka-batch-timeout-ms", 10, "time the kafka producer waits to fill a batch in milliseconds")
+	viper.BindPFlag("kafka.batchTimeoutMs", flags.Lookup("kafka-batch-timeout-ms"))
+
+	flags.Int("kafka-min-bytes", 1, "min bytes the kafka consumer waits for in a fetch")
+	viper.BindPFlag("kafka.minBytes", flags.Lookup("kafka-min-bytes"))
+
+	flags.Int("kafka-max-wait-ms", 10000, "max time a kafka fetch waits for min bytes in milliseconds")
+	viper.BindPFlag("kafka.maxWaitMs", flags.Lookup("kafka-max-wait-ms"))
+
+	flags.String("kafka-start-offset", "first", "offset a new kafka consumer group starts at, first or last")
+	viper.BindPFlag("kafka.startOffset", flags.Lookup("kafka-start-offset"))
+
+	flags.Int("kafka-commit-interval-ms", 0, "interval kafka commits are flushed at in milliseconds, 0 commits synchronously")
+	viper.BindPFlag("kafka.commitIntervalMs", flags.Lookup("kafka-commit-interval-ms"))
 }
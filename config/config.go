@@ -2,11 +2,28 @@ package config
 
 var GlobalConfig Config
 
+// Config is logged as json on start, secrets are tagged json:"-" to keep
+// them out of the logs.
 type Config struct {
-	Http        HttpConfig        `mapstructure:"http"`
-	Kafka       KafkaConfig       `mapstructure:"kafka"`
-	Lark        LarkConfig        `mapstructure:"lark"`
-	AlertFields AlertFieldsConfig `mapstructure:"alertFields"`
+	Http         HttpConfig         `mapstructure:"http"`
+	Kafka        KafkaConfig        `mapstructure:"kafka"`
+	Lark         LarkConfig         `mapstructure:"lark"`
+	AlertFields  AlertFieldsConfig  `mapstructure:"alertFields"`
+	State        StateConfig        `mapstructure:"state"`
+	Route        RouteConfig        `mapstructure:"route"`
+	Receivers    []ReceiverConfig   `mapstructure:"receivers"`
+	Templates    []TemplateConfig   `mapstructure:"templates"`
+	Card         CardConfig         `mapstructure:"card"`
+	Alertmanager AlertmanagerConfig `mapstructure:"alertmanager"`
+	Policy       PolicyConfig       `mapstructure:"policy"`
+	Delivery     DeliveryConfig     `mapstructure:"delivery"`
+	Queue        QueueConfig        `mapstructure:"queue"`
+	Tracing      TracingConfig      `mapstructure:"tracing"`
+	Health       HealthConfig       `mapstructure:"health"`
+	Webhook      WebhookConfig      `mapstructure:"webhook"`
+	// ShutdownTimeoutSeconds bounds how long in-flight deliveries and card
+	// actions are waited for on shutdown.
+	ShutdownTimeoutSeconds int `mapstructure:"shutdownTimeoutSeconds"`
 }
 
 type AlertFieldsConfig struct {
@@ -16,12 +33,21 @@ type AlertFieldsConfig struct {
 	GrafanaURLKeys   []string `mapstructure:"grafanaUrlKeys"`
 	RunBookURLKeys   []string `mapstructure:"runbookUrlKeys"`
 	DescriptionKeys  []string `mapstructure:"descriptionKeys"`
+	TemplateKeys     []string `mapstructure:"templateKeys"`
 }
 
-
 type HttpConfig struct {
-	Host string `mapstructure:"host"`
-	Port int    `mapstructure:"port"`
+	Host string        `mapstructure:"host"`
+	Port int           `mapstructure:"port"`
+	TLS  HttpTLSConfig `mapstructure:"tls"`
+}
+
+// HttpTLSConfig serves https when CertFile is set. Client certificates are
+// verified against ClientCAFile when presented, webhooks can require them.
+type HttpTLSConfig struct {
+	CertFile     string `mapstructure:"certFile"`
+	KeyFile      string `mapstructure:"keyFile"`
+	ClientCAFile string `mapstructure:"clientCAFile"`
 }
 
 type KafkaConfig struct {
@@ -31,14 +57,235 @@ type KafkaConfig struct {
 	MaxBytes          int      `mapstructure:"maxBytes"`
 	WriteRetries      int      `mapstructure:"writeRetries"`
 	WriteRetryBackoff int      `mapstructure:"writeRetryBackoffMs"`
+	// DLQTopic receives messages that can't be delivered, empty disables
+	// dead-lettering and deliveries are retried until they succeed.
+	DLQTopic            string `mapstructure:"dlqTopic"`
+	MaxDeliveryAttempts int    `mapstructure:"maxDeliveryAttempts"`
+
+	TLS  KafkaTLSConfig  `mapstructure:"tls"`
+	SASL KafkaSASLConfig `mapstructure:"sasl"`
+
+	// producer tuning
+	Compression    string `mapstructure:"compression"`
+	RequiredAcks   int    `mapstructure:"requiredAcks"`
+	BatchSize      int    `mapstructure:"batchSize"`
+	BatchTimeoutMs int    `mapstructure:"batchTimeoutMs"`
+
+	// consumer tuning
+	MinBytes         int    `mapstructure:"minBytes"`
+	MaxWaitMs        int    `mapstructure:"maxWaitMs"`
+	StartOffset      string `mapstructure:"startOffset"`
+	CommitIntervalMs int    `mapstructure:"commitIntervalMs"`
+}
+
+type KafkaTLSConfig struct {
+	Enabled            bool   `mapstructure:"enabled"`
+	CAFile             string `mapstructure:"caFile"`
+	CertFile           string `mapstructure:"certFile"`
+	KeyFile            string `mapstructure:"keyFile"`
+	InsecureSkipVerify bool   `mapstructure:"insecureSkipVerify"`
+}
+
+type KafkaSASLConfig struct {
+	// Mechanism is one of plain, scram-sha-256, scram-sha-512, empty
+	// disables sasl.
+	Mechanism string `mapstructure:"mechanism"`
+	Username  string `mapstructure:"username"`
+	Password  string `mapstructure:"password" json:"-"`
 }
 
 type LarkConfig struct {
 	AppID             string `mapstructure:"appID"`
-	AppSecret         string `mapstructure:"appSecret"`
-	EncryptKey        string `mapstructure:"encryptKey"`
-	VerificationToken string `mapstructure:"verificationToken"`
+	AppSecret         string `mapstructure:"appSecret" json:"-"`
+	EncryptKey        string `mapstructure:"encryptKey" json:"-"`
+	VerificationToken string `mapstructure:"verificationToken" json:"-"`
 	ChatID            string `mapstructure:"chatID"`
 	SendRetries       int    `mapstructure:"sendRetries"`
 	SendRetryBackoff  int    `mapstructure:"sendRetryBackoffMs"`
+	// CallbackMaxSkewSeconds bounds the age of a signed card callback.
+	CallbackMaxSkewSeconds int `mapstructure:"callbackMaxSkewSeconds"`
+	CallbackNonceCacheSize int `mapstructure:"callbackNonceCacheSize"`
+	// PermanentErrorCodes are the lark api codes deliveries are not retried
+	// on, alert.DefaultPermanentErrorCodes when empty.
+	PermanentErrorCodes []int `mapstructure:"permanentErrorCodes"`
+}
+
+// StateConfig persists the card state to Path when Enabled, it is kept in
+// memory otherwise.
+type StateConfig struct {
+	Enabled                bool   `mapstructure:"enabled"`
+	Path                   string `mapstructure:"path"`
+	TTLHours               int    `mapstructure:"ttlHours"`
+	CleanupIntervalMinutes int    `mapstructure:"cleanupIntervalMinutes"`
+}
+
+type RouteConfig struct {
+	Matchers []string      `mapstructure:"matchers"`
+	ChatIDs  []string      `mapstructure:"chatIDs"`
+	Continue bool          `mapstructure:"continue"`
+	Routes   []RouteConfig `mapstructure:"routes"`
+}
+
+type ReceiverConfig struct {
+	Name     string   `mapstructure:"name"`
+	ChatIDs  []string `mapstructure:"chatIDs"`
+	Mention  string   `mapstructure:"mention"`
+	Template string   `mapstructure:"template"`
+	Mode     string   `mapstructure:"mode"`
+	// Auth replaces webhook.auth for /lark/webhook/<name> and for webhooks to
+	// /lark/webhook naming the receiver.
+	Auth *WebhookAuthConfig `mapstructure:"auth"`
+}
+
+type TemplateConfig struct {
+	Name string `mapstructure:"name"`
+	File string `mapstructure:"file"`
+	Text string `mapstructure:"text"`
+}
+
+type CardConfig struct {
+	Mode             string `mapstructure:"mode"`
+	GroupedMaxAlerts int    `mapstructure:"groupedMaxAlerts"`
+}
+
+type AlertmanagerConfig struct {
+	URLs        []string `mapstructure:"urls"`
+	BearerToken string   `mapstructure:"bearerToken" json:"-"`
+	Username    string   `mapstructure:"username"`
+	Password    string   `mapstructure:"password" json:"-"`
+	TimeoutMs   int      `mapstructure:"timeoutMs"`
+}
+
+type PolicyConfig struct {
+	Rules []PolicyRuleConfig `mapstructure:"rules"`
+}
+
+// PolicyRuleConfig allows the listed operators to take actions from a card,
+// a rule without operators allows everyone.
+type PolicyRuleConfig struct {
+	Actions           []string `mapstructure:"actions"`
+	OpenIDs           []string `mapstructure:"openIDs"`
+	Emails            []string `mapstructure:"emails"`
+	DepartmentIDs     []string `mapstructure:"departmentIDs"`
+	UserGroupIDs      []string `mapstructure:"userGroupIDs"`
+	Assignees         bool     `mapstructure:"assignees"`
+	MaxSilenceMinutes int      `mapstructure:"maxSilenceMinutes"`
+}
+
+type DeliveryConfig struct {
+	// Mode is queue or direct, direct delivery skips the queue backend and
+	// rejects webhooks while QueueSize notifications are pending.
+	Mode      string `mapstructure:"mode"`
+	QueueSize int    `mapstructure:"queueSize"`
+	// Workers is the number of lanes delivering messages in parallel,
+	// messages of the same notification group always share a lane.
+	Workers     int `mapstructure:"workers"`
+	MaxInFlight int `mapstructure:"maxInFlight"`
+}
+
+// QueueConfig selects the queue between the webhook and the delivery
+// workers, kafka is configured in KafkaConfig.
+type QueueConfig struct {
+	Backend string `mapstructure:"backend"`
+	// FanOut writes every alert of a notification as its own record keyed
+	// by fingerprint, notifications of grouped receivers stay one record.
+	FanOut bool `mapstructure:"fanOut"`
+	// Envelope wraps records in a versioned envelope with ingestion
+	// metadata, disable it while workers without envelope support still run.
+	Envelope   bool             `mapstructure:"envelope"`
+	MemorySize int              `mapstructure:"memorySize"`
+	WAL        WALQueueConfig   `mapstructure:"wal"`
+	Redis      RedisQueueConfig `mapstructure:"redis"`
+	Spool      SpoolConfig      `mapstructure:"spool"`
+}
+
+type WALQueueConfig struct {
+	Path         string `mapstructure:"path"`
+	SegmentBytes int64  `mapstructure:"segmentBytes"`
+}
+
+type RedisQueueConfig struct {
+	Addrs    []string `mapstructure:"addrs"`
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password" json:"-"`
+	DB       int      `mapstructure:"db"`
+	Stream   string   `mapstructure:"stream"`
+	Group    string   `mapstructure:"group"`
+	// Consumer names this instance in the group, it defaults to the hostname
+	// and must be unique and stable across restarts.
+	Consumer string `mapstructure:"consumer"`
+	// MaxLen trims the stream to about that many entries, pending ones
+	// included, so it must stay well above the worst-case backlog. Pending
+	// entries that were trimmed are dropped with a warning.
+	MaxLen           int64 `mapstructure:"maxLen"`
+	ClaimIdleSeconds int   `mapstructure:"claimIdleSeconds"`
+}
+
+// SpoolConfig keeps webhooks on local disk while the queue can't be
+// written to.
+type SpoolConfig struct {
+	Enabled      bool   `mapstructure:"enabled"`
+	Path         string `mapstructure:"path"`
+	MaxBytes     int64  `mapstructure:"maxBytes"`
+	SegmentBytes int64  `mapstructure:"segmentBytes"`
+}
+
+type TracingConfig struct {
+	// Exporter is otlp or stdout, tracing is disabled when empty.
+	Exporter string `mapstructure:"exporter"`
+	// Endpoint is the host:port of the otlp collector, Protocol is http or
+	// grpc.
+	Endpoint    string  `mapstructure:"endpoint"`
+	Protocol    string  `mapstructure:"protocol"`
+	Insecure    bool    `mapstructure:"insecure"`
+	SampleRatio float64 `mapstructure:"sampleRatio"`
+	ServiceName string  `mapstructure:"serviceName"`
+}
+
+type HealthConfig struct {
+	TimeoutSeconds int `mapstructure:"timeoutSeconds"`
+	// CacheSeconds is how long a readiness report is served before the
+	// checks run again.
+	CacheSeconds int `mapstructure:"cacheSeconds"`
+	// StuckSeconds is how long a worker may spend on one delivery attempt
+	// before it is reported as stuck by /livez.
+	StuckSeconds int `mapstructure:"stuckSeconds"`
+}
+
+type WebhookConfig struct {
+	Auth WebhookAuthConfig `mapstructure:"auth"`
+}
+
+// WebhookAuthConfig lists the credentials webhooks are accepted with, any
+// one of them is enough. Webhooks are not authenticated when none is set.
+type WebhookAuthConfig struct {
+	// BearerTokens are all accepted, so tokens can be rotated.
+	BearerTokens []string            `mapstructure:"bearerTokens" json:"-"`
+	BasicAuth    []BasicAuthConfig   `mapstructure:"basicAuth"`
+	HMAC         WebhookHMACConfig   `mapstructure:"hmac"`
+	ClientCert   WebhookClientConfig `mapstructure:"clientCert"`
+}
+
+type BasicAuthConfig struct {
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password" json:"-"`
+}
+
+// WebhookHMACConfig accepts webhooks signed with one of Secrets. The
+// signature is the hex encoded hmac-sha256 of "<timestamp>.<body>", the
+// timestamp is in unix seconds.
+type WebhookHMACConfig struct {
+	Secrets         []string `mapstructure:"secrets" json:"-"`
+	SignatureHeader string   `mapstructure:"signatureHeader"`
+	TimestampHeader string   `mapstructure:"timestampHeader"`
+	MaxSkewSeconds  int      `mapstructure:"maxSkewSeconds"`
+}
+
+// WebhookClientConfig requires a client certificate verified against
+// http.tls.clientCAFile, in addition to the other credentials if any.
+type WebhookClientConfig struct {
+	Required bool `mapstructure:"required"`
+	// AllowedNames restricts the certificates by common name or dns name,
+	// empty accepts every verified certificate.
+	AllowedNames []string `mapstructure:"allowedNames"`
 }
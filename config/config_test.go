@@ -0,0 +1,32 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLoggedConfigHasNoSecrets(t *testing.T) {
+	c := Config{}
+	c.Kafka.SASL.Password = "secret-sasl"
+	c.Lark.AppSecret = "secret-app"
+	c.Lark.EncryptKey = "secret-encrypt"
+	c.Lark.VerificationToken = "secret-verification"
+	c.Alertmanager.BearerToken = "secret-am-token"
+	c.Alertmanager.Password = "secret-am-password"
+	c.Queue.Redis.Password = "secret-redis"
+	c.Webhook.Auth = WebhookAuthConfig{
+		BearerTokens: []string{"secret-bearer"},
+		BasicAuth:    []BasicAuthConfig{{Username: "am", Password: "secret-basic"}},
+		HMAC:         WebhookHMACConfig{Secrets: []string{"secret-hmac"}},
+	}
+	c.Receivers = []ReceiverConfig{{Name: "team", Auth: &WebhookAuthConfig{BearerTokens: []string{"secret-receiver"}}}}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "secret-") {
+		t.Errorf("logged config contains secrets: %s", b)
+	}
+}
@@ -0,0 +1,17 @@
+// Package configtest lets tests change the global config.
+package configtest
+
+import (
+	"testing"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+)
+
+// Set returns the global config to change, it is restored once the test is
+// done.
+func Set(t testing.TB) *config.Config {
+	t.Helper()
+	saved := config.GlobalConfig
+	t.Cleanup(func() { config.GlobalConfig = saved })
+	return &config.GlobalConfig
+}
@@ -0,0 +1,207 @@
+package alert
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-lark/lark"
+	"github.com/go-lark/lark/card"
+	"github.com/prometheus/alertmanager/template"
+)
+
+// Card modes, ModeAlert posts one card per alert while ModeGrouped posts one
+// card per alertmanager notification group.
+const (
+	ModeAlert   = "alert"
+	ModeGrouped = "grouped"
+)
+
+const defaultGroupMaxRows = 10
+
+// GroupCard renders all alerts of one webhook.Message on a single card.
+type GroupCard struct {
+	Title             string
+	GroupLabels       template.KV
+	CommonLabels      template.KV
+	CommonAnnotations template.KV
+	Alerts            template.Alerts
+	TruncatedAlerts   uint64
+	ExternalURL       string
+	AssignEmails      []string
+	Mention           string
+	// MaxRows is the number of alerts listed before the rest is folded into
+	// a collapsible panel.
+	MaxRows int
+}
+
+func (g *GroupCard) Firing() int {
+	return len(g.Alerts.Firing())
+}
+
+func (g *GroupCard) Resolved() int {
+	return len(g.Alerts.Resolved())
+}
+
+func (g *GroupCard) IsResolved() bool {
+	return g.Firing() == 0
+}
+
+func (g *GroupCard) SetTitle() string {
+	if g.IsResolved() {
+		return fmt.Sprintf("✅ [RESOLVED:%d] %s", g.Resolved(), g.Title)
+	}
+	if g.Resolved() > 0 {
+		return fmt.Sprintf("🚨 [FIRING:%d RESOLVED:%d] %s", g.Firing(), g.Resolved(), g.Title)
+	}
+	return fmt.Sprintf("🚨 [FIRING:%d] %s", g.Firing(), g.Title)
+}
+
+func kvMD(kv template.KV) string {
+	if len(kv) == 0 {
+		return "N/A"
+	}
+	pairs := make([]string, 0, len(kv))
+	for _, p := range kv.SortedPairs() {
+		pairs = append(pairs, fmt.Sprintf("`%s=%s`", p.Name, p.Value))
+	}
+	return strings.Join(pairs, " ")
+}
+
+func (g *GroupCard) GroupLabelsMD() string {
+	return fmt.Sprintf("**🏷 Group labels:**\n%s", kvMD(g.GroupLabels))
+}
+
+func (g *GroupCard) CommonLabelsMD() string {
+	return fmt.Sprintf("**📌 Common labels:**\n%s", kvMD(g.CommonLabels.Remove(g.GroupLabels.Names())))
+}
+
+func (g *GroupCard) CommonAnnotationsMD() string {
+	if len(g.CommonAnnotations) == 0 {
+		return "**👉 Description: **\nN/A"
+	}
+	lines := make([]string, 0, len(g.CommonAnnotations))
+	for _, p := range g.CommonAnnotations.SortedPairs() {
+		lines = append(lines, fmt.Sprintf("%s: %s", p.Name, p.Value))
+	}
+	return fmt.Sprintf("**👉 Description: **\n%s", strings.Join(lines, "\n"))
+}
+
+func (g *GroupCard) CountMD() (string, string) {
+	return fmt.Sprintf("**🔥 Firing:**\n%d", g.Firing()),
+		fmt.Sprintf("**✅ Resolved:**\n%d", g.Resolved())
+}
+
+func (g *GroupCard) TruncatedMD() string {
+	return fmt.Sprintf("⚠️ %d more alerts were truncated by alertmanager and are not listed", g.TruncatedAlerts)
+}
+
+func (g *GroupCard) alertRow(b *lark.CardBuilder, a template.Alert) card.Element {
+	status := "🔴"
+	if a.Status == StatusResolved {
+		status = "🟢"
+	}
+	name := a.Labels["alertname"]
+	if name == "" {
+		name = a.Fingerprint
+	}
+	labels := a.Labels.Remove(append(g.CommonLabels.Names(), "alertname"))
+	return b.ColumnSet(
+		b.Column(b.Markdown(status)).Width("auto"),
+		b.Column(b.Markdown(name)).Width("weighted").Weight(2),
+		b.Column(b.Markdown(a.StartsAt.Format(displayTimeLayout))).Width("weighted").Weight(2),
+		b.Column(b.Markdown(kvMD(labels))).Width("weighted").Weight(3),
+	).FlexMode("none")
+}
+
+func (g *GroupCard) Card() string {
+	maxRows := g.MaxRows
+	if maxRows <= 0 {
+		maxRows = defaultGroupMaxRows
+	}
+	// firing alerts first, oldest first
+	alerts := append(template.Alerts{}, g.Alerts...)
+	sort.SliceStable(alerts, func(i, j int) bool {
+		if alerts[i].Status != alerts[j].Status {
+			return alerts[i].Status != StatusResolved
+		}
+		return alerts[i].StartsAt.Before(alerts[j].StartsAt)
+	})
+
+	b := lark.NewCardBuilder()
+	firing, resolved := g.CountMD()
+	assign := &LarkCard{AssignEmails: g.AssignEmails, Mention: g.Mention}
+	elements := []card.Element{
+		b.ColumnSet(
+			b.Column(b.Markdown(firing)).Width("weighted").Weight(1),
+			b.Column(b.Markdown(resolved)).Width("weighted").Weight(1),
+		).FlexMode("none"),
+		b.Markdown(g.GroupLabelsMD()),
+		b.Markdown(g.CommonLabelsMD()),
+		b.Markdown(g.CommonAnnotationsMD()),
+		b.Markdown(assign.AssignEmailMD()),
+		b.Hr(),
+		b.ColumnSet(
+			b.Column(b.Markdown("**St.**")).Width("auto"),
+			b.Column(b.Markdown("**Alert**")).Width("weighted").Weight(2),
+			b.Column(b.Markdown("**Starts at**")).Width("weighted").Weight(2),
+			b.Column(b.Markdown("**Labels**")).Width("weighted").Weight(3),
+		).FlexMode("none"),
+	}
+	var folded []card.Element
+	for i, a := range alerts {
+		if i < maxRows {
+			elements = append(elements, g.alertRow(b, a))
+		} else {
+			folded = append(folded, g.alertRow(b, a))
+		}
+	}
+	if len(folded) > 0 {
+		elements = append(elements, &collapsiblePanel{
+			title:    fmt.Sprintf("**Show %d more alerts**", len(folded)),
+			elements: folded,
+		})
+	}
+	if g.TruncatedAlerts > 0 {
+		elements = append(elements, b.Note().AddText(b.Text(g.TruncatedMD())))
+	}
+	if g.ExternalURL != "" {
+		elements = append(elements, b.Markdown(fmt.Sprintf("[Open in Alertmanager](%s)", g.ExternalURL)))
+	}
+
+	c := b.Card(elements...).Title(g.SetTitle()).UpdateMulti(true)
+	if g.IsResolved() {
+		c = c.Green()
+	} else {
+		c = c.Red()
+	}
+	return c.String()
+}
+
+// collapsiblePanel is the lark collapsible_panel element which the card
+// builder does not provide.
+type collapsiblePanel struct {
+	title    string
+	elements []card.Element
+}
+
+func (p *collapsiblePanel) Render() card.Renderer {
+	elements := make([]card.Renderer, 0, len(p.elements))
+	for _, e := range p.elements {
+		elements = append(elements, e.Render())
+	}
+	return map[string]interface{}{
+		"tag":      "collapsible_panel",
+		"expanded": false,
+		"header": map[string]interface{}{
+			"title": map[string]interface{}{
+				"tag":     "markdown",
+				"content": p.title,
+			},
+		},
+		"border": map[string]interface{}{
+			"color": "grey",
+		},
+		"elements": elements,
+	}
+}
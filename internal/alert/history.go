@@ -0,0 +1,81 @@
+package alert
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxHistory bounds the history kept in the card state and shown on cards.
+const maxHistory = 10
+
+// HistoryEntry records an action taken on a card by a lark user.
+type HistoryEntry struct {
+	Action   string `json:"action"`
+	Operator string `json:"operator"`
+	OpenID   string `json:"open_id"`
+	Time     string `json:"time"`
+}
+
+func NewHistoryEntry(action, operator, openID string) HistoryEntry {
+	return HistoryEntry{
+		Action:   action,
+		Operator: operator,
+		OpenID:   openID,
+		Time:     time.Now().Format("2006-01-02 15:04:05"),
+	}
+}
+
+func (h HistoryEntry) String() string {
+	var verb string
+	switch h.Action {
+	case ActionAcknowledge:
+		verb = "acknowledged"
+	case ActionResolve:
+		verb = "resolved"
+	case ActionSilence:
+		verb = "silenced"
+	case ActionExpireSilence:
+		verb = "expired the silence"
+	default:
+		verb = h.Action
+	}
+	return fmt.Sprintf("%s %s by %s", h.Time, verb, h.Operator)
+}
+
+// AppendHistory appends e and keeps the most recent maxHistory entries.
+func AppendHistory(history []HistoryEntry, e HistoryEntry) []HistoryEntry {
+	history = append(history, e)
+	if len(history) > maxHistory {
+		history = history[len(history)-maxHistory:]
+	}
+	return history
+}
+
+// Acknowledgement returns the latest acknowledgement in history.
+func (l *LarkCard) Acknowledgement() (HistoryEntry, bool) {
+	for i := len(l.History) - 1; i >= 0; i-- {
+		if l.History[i].Action == ActionAcknowledge {
+			return l.History[i], true
+		}
+	}
+	return HistoryEntry{}, false
+}
+
+func (l *LarkCard) IsAcknowledged() bool {
+	_, acked := l.Acknowledgement()
+	return acked
+}
+
+func (l *LarkCard) AcknowledgedMD() string {
+	ack, _ := l.Acknowledgement()
+	return fmt.Sprintf("**🙋 Acknowledged by:** %s (%s)\n**At:** %s", ack.Operator, ack.OpenID, ack.Time)
+}
+
+func (l *LarkCard) HistoryMD() string {
+	lines := make([]string, 0, len(l.History))
+	for _, h := range l.History {
+		lines = append(lines, h.String())
+	}
+	return strings.Join(lines, "\n")
+}
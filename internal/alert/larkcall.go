@@ -0,0 +1,38 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/internal/metrics"
+	"github.com/404LifeFound/alertmanager-lark/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// LarkCall is a lark api call being traced and measured.
+type LarkCall struct {
+	method string
+	start  time.Time
+	span   trace.Span
+}
+
+// StartLarkCall starts the span of a call to the lark api method.
+func StartLarkCall(ctx context.Context, method string, attrs ...attribute.KeyValue) *LarkCall {
+	_, span := tracing.Tracer.Start(ctx, "lark "+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	return &LarkCall{method: method, start: time.Now(), span: span}
+}
+
+// End records the outcome of the call, code is the lark error code of the
+// response and 0 when there is none.
+func (c *LarkCall) End(code int, err error) {
+	metrics.ObserveLarkCall(c.method, c.start, code, err)
+	c.span.SetAttributes(attribute.Int("lark.code", code))
+	if err == nil && code != 0 {
+		err = fmt.Errorf("lark api error: code=%d", code)
+	}
+	tracing.End(c.span, err)
+}
@@ -8,14 +8,19 @@ import (
 	"time"
 
 	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/internal/health"
 	"github.com/go-lark/lark"
+	"github.com/go-lark/lark/card"
 	"github.com/rs/zerolog/log"
 	"go.uber.org/fx"
 )
 
-func NewLark(lc fx.Lifecycle) *lark.Bot {
+func NewLark(lc fx.Lifecycle, registry *health.Registry) *lark.Bot {
 	bot := lark.NewChatBot(config.GlobalConfig.Lark.AppID, config.GlobalConfig.Lark.AppSecret)
 	bot.SetDomain(lark.DomainLark)
+	registry.Readiness("lark", func(ctx context.Context) error {
+		return checkTenantToken(ctx, bot)
+	})
 	lc.Append(fx.Hook{
 		OnStart: func(context.Context) error {
 			bot.StartHeartbeat()
@@ -29,41 +34,135 @@ func NewLark(lc fx.Lifecycle) *lark.Bot {
 	return bot
 }
 
+// checkTenantToken requests a tenant access token with the app credentials,
+// without replacing the token the bot uses.
+func checkTenantToken(ctx context.Context, bot *lark.Bot) error {
+	call := StartLarkCall(ctx, "GetTenantAccessTokenInternal")
+	resp, err := bot.GetTenantAccessTokenInternal(false)
+	code := 0
+	if resp != nil {
+		code = resp.Code
+	}
+	call.End(code, err)
+	if err != nil {
+		return err
+	}
+	if resp.Code != 0 {
+		return fmt.Errorf("lark api error: code=%d, msg=%s", resp.Code, resp.Msg)
+	}
+	return nil
+}
+
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+)
+
+// Mention policies decide who is @mentioned on a card. The default mentions
+// the assignees and falls back to everyone when there are none.
+const (
+	MentionDefault   = ""
+	MentionAll       = "all"
+	MentionAssignees = "assignees"
+	MentionNone      = "none"
+)
+
+const displayTimeLayout = "2006-01-02 15:04:05.000"
+
+// Card actions sent back in the value of the card buttons.
+const (
+	ActionResolve       = "resolve"
+	ActionAcknowledge   = "ack"
+	ActionSilence       = "silence"
+	ActionExpireSilence = "expire_silence"
+)
+
+// SilenceDurations are offered as silence buttons, a custom end can be
+// picked with the datetime picker.
+var SilenceDurations = []string{"1h", "4h", "24h"}
+
 type LarkCard struct {
-	Title        string
-	Project      string
-	Time         string
-	GrafanaURL   string
-	RunBookURL   string
-	AssignEmails []string
-	Metric       string
-	Description  string
+	Title         string
+	Status        string
+	Fingerprint   string
+	Labels        map[string]string
+	Project       string
+	Time          string
+	EndsAt        string
+	GrafanaURL    string
+	RunBookURL    string
+	AssignEmails  []string
+	Mention       string
+	Metric        string
+	Description   string
+	SilenceID     string
+	SilencedUntil string
+	GroupKey      string
+	History       []HistoryEntry
 }
 
+// CardActionValue is the value of the card buttons. It only names the alert,
+// the card it was triggered on is kept in the card state.
 type CardActionValue struct {
-	Title       string `json:"title"`
-	Project     string `json:"project"`
-	Time        string `json:"time"`
-	GrafanaURL  string `json:"grafana_url"`
-	RunBookURL  string `json:"runbook_url"`
-	Metric      string `json:"metric"`
-	Description string `json:"description"`
+	Fingerprint string `json:"fingerprint"`
+	GroupKey    string `json:"group_key"`
 	Action      string `json:"action"`
+	Duration    string `json:"duration,omitempty"`
+}
+
+// parseTime accepts the RFC3339 timestamps sent by alertmanager as well as
+// the display layout already rendered on a card.
+func parseTime(s string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{time.RFC3339Nano, time.RFC3339, displayTimeLayout} {
+		var t time.Time
+		if t, err = time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
 }
 
 func (l *LarkCard) ParseTime() (string, error) {
-	t, err := time.Parse(time.RFC3339Nano, l.Time)
+	t, err := parseTime(l.Time)
 	if err != nil {
-		t, err = time.Parse(time.RFC3339, l.Time)
-		if err != nil {
-			log.Error().Err(err).Msgf("failed to parse time: %s", l.Time)
-			return "", err
-		}
+		log.Error().Err(err).Msgf("failed to parse time: %s", l.Time)
+		return "", err
 	}
-	return t.Format("2006-01-02 15:04:05.000"), nil
+	return t.Format(displayTimeLayout), nil
 
 }
 
+func (l *LarkCard) ParseEndsAt() (string, error) {
+	t, err := parseTime(l.EndsAt)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to parse ends at: %s", l.EndsAt)
+		return "", err
+	}
+	return t.Format(displayTimeLayout), nil
+}
+
+// Duration returns how long the alert was firing, it is only known once the
+// alert carries an EndsAt.
+func (l *LarkCard) Duration() (time.Duration, error) {
+	start, err := parseTime(l.Time)
+	if err != nil {
+		return 0, err
+	}
+	end, err := parseTime(l.EndsAt)
+	if err != nil {
+		return 0, err
+	}
+	if end.Before(start) {
+		return 0, fmt.Errorf("ends at %s is before starts at %s", l.EndsAt, l.Time)
+	}
+	return end.Sub(start).Round(time.Second), nil
+}
+
+func (l *LarkCard) IsResolved() bool {
+	return l.Status == StatusResolved
+}
+
 // http://example.com:9090/graph?g0.expr=go_memstats_alloc_bytes+%3E+0\u0026g0.tab=1
 func (l *LarkCard) ParseExpr() (string, error) {
 	u, err := url.Parse(l.Metric)
@@ -96,12 +195,17 @@ func (l *LarkCard) WithTime(t string) *LarkCard {
 	return l
 }
 
+func (l *LarkCard) WithEndsAt(t string) *LarkCard {
+	l.EndsAt = t
+	return l
+}
+
 func (l *LarkCard) SetTitle() string {
 	return fmt.Sprintf("🚨 %s", l.Title)
 }
 
 func (l *LarkCard) SetResolvedTitle() string {
-	return fmt.Sprintf("%s (Resolved)", l.SetTitle())
+	return fmt.Sprintf("✅ %s (Resolved)", l.Title)
 }
 
 func (l *LarkCard) ProjectMD() string {
@@ -112,6 +216,18 @@ func (l *LarkCard) TimeMD() string {
 	return fmt.Sprintf("**🕐 Time:**\n%s", l.Time)
 }
 
+func (l *LarkCard) EndsAtMD() string {
+	return fmt.Sprintf("**🏁 Resolved at:**\n%s", l.EndsAt)
+}
+
+func (l *LarkCard) DurationMD() string {
+	d, err := l.Duration()
+	if err != nil {
+		return "**⏱ Duration:**\nN/A"
+	}
+	return fmt.Sprintf("**⏱ Duration:**\n%s", d)
+}
+
 func (l *LarkCard) GrafanaURLMD() string {
 	return fmt.Sprintf("**🔗 Grafana: **\n%s", l.GrafanaURL)
 }
@@ -129,9 +245,23 @@ func (l *LarkCard) AssignEmailMD() string {
 			filtered = append(filtered, e)
 		}
 	}
-	if len(filtered) == 0 {
+	switch l.Mention {
+	case MentionNone:
+		if len(filtered) == 0 {
+			return assign_s + "N/A"
+		}
+		return assign_s + strings.Join(filtered, ", ")
+	case MentionAll:
 		assign_s += "<at id=all></at>"
-		return assign_s
+	case MentionAssignees:
+		if len(filtered) == 0 {
+			return assign_s + "N/A"
+		}
+	default:
+		if len(filtered) == 0 {
+			assign_s += "<at id=all></at>"
+			return assign_s
+		}
 	}
 	for _, e := range filtered {
 		assign_s += fmt.Sprintf("<at email=%s></at>", e)
@@ -143,21 +273,98 @@ func (l *LarkCard) MetricMD() string {
 	return fmt.Sprintf("**📊 Metric: **\n```\n%s\n```", l.Metric)
 }
 
+func (l *LarkCard) SilenceMD() string {
+	return fmt.Sprintf("**🔕 Silenced until:** %s\n**Silence ID:** `%s`", l.SilencedUntil, l.SilenceID)
+}
+
+func (l *LarkCard) IsSilenced() bool {
+	return l.SilenceID != ""
+}
+
+func (l *LarkCard) actionValue(action string) map[string]interface{} {
+	return map[string]interface{}{
+		"fingerprint": l.Fingerprint,
+		"group_key":   l.GroupKey,
+		"action":      action,
+	}
+}
+
+// actions returns the buttons of a firing card, the silence actions are
+// only offered when an alertmanager is configured.
+func (l *LarkCard) actions(b *lark.CardBuilder) []card.Element {
+	var actions []card.Element
+	if !l.IsAcknowledged() {
+		actions = append(actions, b.Button(b.Text("Acknowledge")).Value(l.actionValue(ActionAcknowledge)))
+	}
+	actions = append(actions, b.Button(b.Text("Resolved")).Primary().Value(l.actionValue(ActionResolve)))
+	if len(config.GlobalConfig.Alertmanager.URLs) == 0 || len(l.Labels) == 0 {
+		return actions
+	}
+	if l.IsSilenced() {
+		return append(actions,
+			b.Button(b.Text("Expire silence")).Danger().Value(l.actionValue(ActionExpireSilence)),
+		)
+	}
+	for _, d := range SilenceDurations {
+		v := l.actionValue(ActionSilence)
+		v["duration"] = d
+		actions = append(actions, b.Button(b.Text("Silence "+d)).Value(v))
+	}
+	return append(actions,
+		b.DatetimePicker().Placeholder("Silence until...").Value(l.actionValue(ActionSilence)),
+	)
+}
+
+func (l *LarkCard) actionElement(b *lark.CardBuilder) card.Element {
+	return b.Action(l.actions(b)...)
+}
+
 func (l *LarkCard) DescriptionMD() string {
 	return fmt.Sprintf("**👉 Description: **\n%s", l.Description)
 }
 
-func (l *LarkCard) NewLarkCard() string {
+// Card renders the card matching the status of the alert.
+func (l *LarkCard) Card() string {
+	if l.IsResolved() {
+		return l.NewResolvedCard()
+	}
+	return l.NewLarkCard()
+}
+
+// Display returns a copy of the card formatted the way the built-in cards
+// show it, card templates use it for the same values.
+func (l *LarkCard) Display() *LarkCard {
+	d := *l
+	d.format()
+	return &d
+}
+
+// format replaces the metric url by its expression and the times by their
+// display layout.
+func (l *LarkCard) format() {
 	metric, err := l.ParseExpr()
 	if err == nil && metric != "" {
 		l.WithMetric(metric)
 	}
+	if l.IsResolved() && l.EndsAt == "" {
+		l.WithEndsAt(time.Now().Format(time.RFC3339Nano))
+	}
 	t, err := l.ParseTime()
 	if err == nil && t != "" {
 		l.WithTime(t)
 	}
+	if l.IsResolved() {
+		e, err := l.ParseEndsAt()
+		if err == nil && e != "" {
+			l.WithEndsAt(e)
+		}
+	}
+}
+
+func (l *LarkCard) NewLarkCard() string {
+	l.format()
 	b := lark.NewCardBuilder()
-	c := b.Card(
+	elements := []card.Element{
 		b.ColumnSet(
 			b.Column(b.Markdown(l.ProjectMD())).Width("weighted").Weight(1),
 			b.Column(b.Markdown(l.TimeMD())).Width("weighted").Weight(1),
@@ -169,29 +376,34 @@ func (l *LarkCard) NewLarkCard() string {
 		b.Markdown(l.AssignEmailMD()),
 		b.Markdown(l.MetricMD()),
 		b.Markdown(l.DescriptionMD()),
-		b.Action(
-			b.Button(b.Text("Resolved")).Primary().Value(map[string]interface{}{
-				"title":       l.Title,
-				"project":     l.Project,
-				"time":        l.Time,
-				"grafana_url": l.GrafanaURL,
-				"runbook_url": l.RunBookURL,
-				"metric":      l.Metric,
-				"description": l.Description,
-				"action":      "resolve",
-			}),
-		),
-	).Title(l.SetTitle()).Red().UpdateMulti(true)
+	}
+	if l.IsAcknowledged() {
+		elements = append(elements, b.Markdown(l.AcknowledgedMD()))
+	}
+	if l.IsSilenced() {
+		elements = append(elements, b.Markdown(l.SilenceMD()))
+	}
+	elements = append(elements, l.actionElement(b))
+	if len(l.History) > 0 {
+		elements = append(elements, b.Note().AddText(b.Text(l.HistoryMD())))
+	}
+	c := b.Card(elements...).Title(l.SetTitle()).Red().UpdateMulti(true)
 	return c.String()
 }
 
 func (l *LarkCard) NewResolvedCard() string {
+	l.format()
+	duration := l.DurationMD()
 	b := lark.NewCardBuilder()
-	c := b.Card(
+	elements := []card.Element{
 		b.ColumnSet(
 			b.Column(b.Markdown(l.ProjectMD())).Width("weighted").Weight(1),
 			b.Column(b.Markdown(l.TimeMD())).Width("weighted").Weight(1),
 		).FlexMode("none"),
+		b.ColumnSet(
+			b.Column(b.Markdown(l.EndsAtMD())).Width("weighted").Weight(1),
+			b.Column(b.Markdown(duration)).Width("weighted").Weight(1),
+		).FlexMode("none"),
 		b.ColumnSet(
 			b.Column(b.Markdown(l.GrafanaURLMD())).Width("weighted").Weight(1),
 			b.Column(b.Markdown(l.RunbookMD())).Width("weighted").Weight(1),
@@ -199,6 +411,10 @@ func (l *LarkCard) NewResolvedCard() string {
 		b.Markdown(l.AssignEmailMD()),
 		b.Markdown(l.MetricMD()),
 		b.Markdown(l.DescriptionMD()),
-	).Title(l.SetResolvedTitle()).Green().UpdateMulti(true)
+	}
+	if len(l.History) > 0 {
+		elements = append(elements, b.Note().AddText(b.Text(l.HistoryMD())))
+	}
+	c := b.Card(elements...).Title(l.SetResolvedTitle()).Green().UpdateMulti(true)
 	return c.String()
 }
@@ -0,0 +1,150 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/go-lark/lark"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func sendRetries() (int, time.Duration) {
+	retries := config.GlobalConfig.Lark.SendRetries
+	if retries <= 0 {
+		retries = 1
+	}
+	return retries, time.Duration(config.GlobalConfig.Lark.SendRetryBackoff) * time.Millisecond
+}
+
+// DefaultPermanentErrorCodes are the lark api codes sending a card to the
+// chat again can't fix: invalid receive id, bot not in the chat, bot ability
+// not activated, chat not available to the bot, missing permissions, the chat
+// forbids the bot to send, missing app scopes and, for updates, the message
+// was recalled or deleted.
+var DefaultPermanentErrorCodes = []int{230001, 230002, 230006, 230011, 230013, 230027, 230035, 230110, 99991672}
+
+// APIError is an error code returned by the lark api.
+type APIError struct {
+	Op   string
+	Code int
+	Msg  string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("lark api error on %s: code=%d, msg=%s", e.Op, e.Code, e.Msg)
+}
+
+// Permanent reports whether the call fails again when retried, see
+// lark.permanentErrorCodes.
+func (e *APIError) Permanent() bool {
+	codes := config.GlobalConfig.Lark.PermanentErrorCodes
+	if len(codes) == 0 {
+		codes = DefaultPermanentErrorCodes
+	}
+	return slices.Contains(codes, e.Code)
+}
+
+// IsPermanent reports whether err is a lark api error retrying can't fix.
+func IsPermanent(err error) bool {
+	var api *APIError
+	return errors.As(err, &api) && api.Permanent()
+}
+
+// wait sleeps for d unless ctx is done first. The lark api calls themselves
+// can not be cancelled, they are bounded by the timeout of the bot client.
+func wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// interrupted is returned when ctx is done before the attempts ran out.
+func interrupted(err error, last error) error {
+	if last == nil {
+		return err
+	}
+	return fmt.Errorf("%w, last attempt failed: %v", err, last)
+}
+
+// PostCard sends card to chatID and returns the id of the created message.
+func PostCard(ctx context.Context, bot *lark.Bot, chatID string, card string) (string, error) {
+	retries, backoff := sendRetries()
+	var sendErr error
+	var resp *lark.PostMessageResponse
+	var delay time.Duration
+	for attempt := 1; attempt <= retries; attempt++ {
+		if err := wait(ctx, delay); err != nil {
+			return "", interrupted(err, sendErr)
+		}
+		delay = backoff
+		call := StartLarkCall(ctx, "PostMessage", attribute.String("chat_id", chatID), attribute.Int("attempt", attempt))
+		resp, sendErr = bot.PostMessage(
+			lark.NewMsgBuffer(lark.MsgInteractive).
+				BindChatID(chatID).
+				Card(card).
+				Build(),
+		)
+		code := 0
+		if resp != nil {
+			code = resp.Code
+		}
+		call.End(code, sendErr)
+		if sendErr == nil {
+			if resp.Code != 0 {
+				sendErr = &APIError{Op: "PostMessage", Code: resp.Code, Msg: resp.Msg}
+			} else {
+				return resp.Data.MessageID, nil
+			}
+		}
+		if IsPermanent(sendErr) {
+			break
+		}
+	}
+	return "", sendErr
+}
+
+// UpdateCard replaces the content of an existing card message.
+func UpdateCard(ctx context.Context, bot *lark.Bot, messageID string, card string) error {
+	retries, backoff := sendRetries()
+	var updateErr error
+	var resp *lark.UpdateMessageResponse
+	var delay time.Duration
+	for attempt := 1; attempt <= retries; attempt++ {
+		if err := wait(ctx, delay); err != nil {
+			return interrupted(err, updateErr)
+		}
+		delay = backoff
+		call := StartLarkCall(ctx, "UpdateMessage", attribute.String("message_id", messageID), attribute.Int("attempt", attempt))
+		resp, updateErr = bot.UpdateMessage(messageID,
+			lark.NewMsgBuffer(lark.MsgInteractive).
+				Card(card).
+				Build(),
+		)
+		code := 0
+		if resp != nil {
+			code = resp.Code
+		}
+		call.End(code, updateErr)
+		if updateErr == nil {
+			if resp != nil && resp.Code != 0 {
+				updateErr = &APIError{Op: "UpdateMessage", Code: resp.Code, Msg: resp.Msg}
+			}
+		}
+		if updateErr == nil || IsPermanent(updateErr) {
+			break
+		}
+	}
+	return updateErr
+}
@@ -0,0 +1,85 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config/configtest"
+	"github.com/go-lark/lark"
+)
+
+// larkStandIn answers every message api call with the lark error code, calls
+// receives a value for each call.
+func larkStandIn(t *testing.T, code int) (*lark.Bot, *atomic.Int32, chan struct{}) {
+	t.Helper()
+	var n atomic.Int32
+	calls := make(chan struct{}, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.Add(1)
+		calls <- struct{}{}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"code": %d, "msg": "stand-in error", "data": {"message_id": "om_1"}}`, code)
+	}))
+	t.Cleanup(srv.Close)
+	bot := lark.NewChatBot("app", "secret")
+	bot.SetDomain(srv.URL)
+
+	cfg := configtest.Set(t)
+	cfg.Lark.SendRetries = 5
+	cfg.Lark.SendRetryBackoff = int(time.Minute / time.Millisecond)
+	return bot, &n, calls
+}
+
+func TestSendRetriesStopWhenCancelled(t *testing.T) {
+	sends := map[string]func(ctx context.Context, bot *lark.Bot) error{
+		"post": func(ctx context.Context, bot *lark.Bot) error {
+			_, err := PostCard(ctx, bot, "oc_1", `{"elements": []}`)
+			return err
+		},
+		"update": func(ctx context.Context, bot *lark.Bot) error {
+			return UpdateCard(ctx, bot, "om_1", `{"elements": []}`)
+		},
+	}
+	for name, send := range sends {
+		t.Run(name, func(t *testing.T) {
+			bot, n, calls := larkStandIn(t, 99991400)
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				<-calls
+				cancel()
+			}()
+
+			done := make(chan error, 1)
+			go func() { done <- send(ctx, bot) }()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("want a cancellation error, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("send kept waiting for its retry backoff after the context was cancelled")
+			}
+			if got := n.Load(); got != 1 {
+				t.Errorf("lark was called %d times, want 1", got)
+			}
+		})
+	}
+}
+
+func TestSendSkipsCancelledContext(t *testing.T) {
+	bot, n, _ := larkStandIn(t, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := PostCard(ctx, bot, "oc_1", `{"elements": []}`); !errors.Is(err, context.Canceled) {
+		t.Errorf("want a cancellation error, got %v", err)
+	}
+	if got := n.Load(); got != 0 {
+		t.Errorf("lark was called %d times after the context was cancelled", got)
+	}
+}
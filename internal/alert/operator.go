@@ -0,0 +1,41 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-lark/lark"
+	"github.com/rs/zerolog/log"
+)
+
+// OperatorName describes the lark user with openID as "name <email>",
+// falling back to the open_id when the contact api is not available.
+func OperatorName(ctx context.Context, bot *lark.Bot, openID string) string {
+	if openID == "" {
+		return "unknown"
+	}
+	call := StartLarkCall(ctx, "GetUserInfo")
+	resp, err := bot.GetUserInfo(lark.WithOpenID(openID))
+	code := 0
+	if resp != nil {
+		code = resp.Code
+	}
+	call.End(code, err)
+	if err == nil && resp.Code != 0 {
+		err = fmt.Errorf("lark api error: code=%d, msg=%s", resp.Code, resp.Msg)
+	}
+	if err != nil {
+		log.Warn().Err(err).Msgf("failed to get user info of %s", openID)
+		return openID
+	}
+	user := resp.Data.User
+	switch {
+	case user.Name != "" && user.Email != "":
+		return fmt.Sprintf("%s <%s>", user.Name, user.Email)
+	case user.Name != "":
+		return user.Name
+	case user.Email != "":
+		return user.Email
+	}
+	return openID
+}
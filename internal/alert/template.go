@@ -0,0 +1,276 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/go-lark/lark"
+	"github.com/prometheus/alertmanager/template"
+)
+
+// DefaultTemplate is the built-in card layout rendered by LarkCard.
+const DefaultTemplate = "default"
+
+// CardData is what user supplied card templates are executed with.
+type CardData struct {
+	*template.Data
+	GroupKey        string
+	TruncatedAlerts uint64
+	Alert           template.Alert
+	Card            *LarkCard
+	// Group is set instead of Alert and Card in grouped mode.
+	Group *GroupCard
+}
+
+// Templates holds the user supplied card templates, each of them renders a
+// lark card json.
+type Templates struct {
+	tmpls map[string]*texttemplate.Template
+}
+
+func NewTemplates() (*Templates, error) {
+	t := &Templates{tmpls: map[string]*texttemplate.Template{}}
+	for _, tc := range config.GlobalConfig.Templates {
+		if tc.Name == "" || tc.Name == DefaultTemplate {
+			return nil, fmt.Errorf("invalid card template name %q", tc.Name)
+		}
+		if _, ok := t.tmpls[tc.Name]; ok {
+			return nil, fmt.Errorf("duplicate card template %q", tc.Name)
+		}
+		text := tc.Text
+		if tc.File != "" {
+			b, err := os.ReadFile(tc.File)
+			if err != nil {
+				return nil, fmt.Errorf("read card template %q: %w", tc.Name, err)
+			}
+			text = string(b)
+		}
+		tmpl, err := texttemplate.New(tc.Name).
+			Option("missingkey=zero").
+			Funcs(texttemplate.FuncMap(template.DefaultFuncs)).
+			Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("parse card template %q: %w", tc.Name, err)
+		}
+		t.tmpls[tc.Name] = tmpl
+		for _, mode := range templateModes(tc.Name) {
+			for _, data := range sampleData(mode) {
+				if _, err := t.Render(tc.Name, data); err != nil {
+					return nil, fmt.Errorf("card template %q fails in %s mode: %w", tc.Name, mode, err)
+				}
+			}
+		}
+	}
+	return t, nil
+}
+
+// templateModes returns the card modes of the receivers using the template
+// name. Templates no receiver uses can still be picked by alert labels, they
+// are checked against card.mode.
+func templateModes(name string) []string {
+	defaultMode := config.GlobalConfig.Card.Mode
+	if defaultMode == "" {
+		defaultMode = ModeAlert
+	}
+	var modes []string
+	for _, rc := range config.GlobalConfig.Receivers {
+		if rc.Template != name {
+			continue
+		}
+		mode := rc.Mode
+		if mode == "" {
+			mode = defaultMode
+		}
+		if !slices.Contains(modes, mode) {
+			modes = append(modes, mode)
+		}
+	}
+	if len(modes) == 0 {
+		modes = append(modes, defaultMode)
+	}
+	return modes
+}
+
+func (t *Templates) Has(name string) bool {
+	if name == DefaultTemplate {
+		return true
+	}
+	_, ok := t.tmpls[name]
+	return ok
+}
+
+// Render executes the template called name, an empty name renders the
+// built-in layout.
+func (t *Templates) Render(name string, data *CardData) (string, error) {
+	if name == "" || name == DefaultTemplate {
+		if data.Group != nil {
+			return data.Group.Card(), nil
+		}
+		return data.Card.Card(), nil
+	}
+	tmpl, ok := t.tmpls[name]
+	if !ok {
+		return "", fmt.Errorf("card template %q is not defined", name)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("execute card template %q: %w", name, err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return "", fmt.Errorf("card template %q rendered invalid json: %s", name, buf.String())
+	}
+	if data.Card == nil || data.Card.IsResolved() {
+		return buf.String(), nil
+	}
+	out, err := withActions(buf.Bytes(), data.Card)
+	if err != nil {
+		return "", fmt.Errorf("add card actions to card template %q: %w", name, err)
+	}
+	return out, nil
+}
+
+// withActions adds the card action buttons of l to a card rendered by a
+// template, in front of its closing notes. Cards that already have an action
+// element are left as they are.
+func withActions(rendered []byte, l *LarkCard) (string, error) {
+	var c map[string]json.RawMessage
+	if err := json.Unmarshal(rendered, &c); err != nil {
+		return "", err
+	}
+	if _, ok := c["schema"]; ok {
+		// json 2.0 cards have no action element, their templates place the
+		// buttons themselves
+		return string(rendered), nil
+	}
+	var elements []json.RawMessage
+	if raw, ok := c["elements"]; ok {
+		if err := json.Unmarshal(raw, &elements); err != nil {
+			return "", err
+		}
+	}
+	tags := make([]string, len(elements))
+	for i, e := range elements {
+		var element struct {
+			Tag string `json:"tag"`
+		}
+		json.Unmarshal(e, &element)
+		if element.Tag == "action" {
+			return string(rendered), nil
+		}
+		tags[i] = element.Tag
+	}
+
+	b := lark.NewCardBuilder()
+	action, err := json.Marshal(l.actionElement(b).Render())
+	if err != nil {
+		return "", err
+	}
+	at := len(elements)
+	for at > 0 && tags[at-1] == "note" {
+		at--
+	}
+	elements = slices.Insert(elements, at, json.RawMessage(action))
+	if c["elements"], err = json.Marshal(elements); err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(c)
+	return string(out), err
+}
+
+// sampleData returns the samples templates of mode are validated with.
+func sampleData(mode string) []*CardData {
+	if mode == ModeGrouped {
+		return sampleGroupData()
+	}
+	return sampleCardData()
+}
+
+// sampleGroupData covers a group with firing alerts and a resolved group.
+func sampleGroupData() []*CardData {
+	alerts := sampleCardData()
+	firing, resolved := alerts[0], alerts[1]
+	var samples []*CardData
+	for _, data := range []*CardData{firing, resolved} {
+		group := template.Alerts{resolved.Alert}
+		if data == firing {
+			group = template.Alerts{firing.Alert, resolved.Alert}
+		}
+		samples = append(samples, &CardData{
+			Data: &template.Data{
+				Receiver:          "sample",
+				Status:            data.Status,
+				Alerts:            group,
+				GroupLabels:       data.GroupLabels,
+				CommonLabels:      data.CommonLabels,
+				CommonAnnotations: data.CommonAnnotations,
+				ExternalURL:       "http://alertmanager.example.com",
+			},
+			GroupKey: data.GroupKey,
+			Group: &GroupCard{
+				Title:             "SampleAlert",
+				GroupLabels:       data.GroupLabels,
+				CommonLabels:      data.CommonLabels,
+				CommonAnnotations: data.CommonAnnotations,
+				Alerts:            group,
+				ExternalURL:       "http://alertmanager.example.com",
+			},
+		})
+	}
+	return samples
+}
+
+// sampleCardData is used to validate alert mode templates at startup, it
+// covers both a firing and a resolved alert.
+func sampleCardData() []*CardData {
+	now := time.Now()
+	var samples []*CardData
+	for _, status := range []string{StatusFiring, StatusResolved} {
+		a := template.Alert{
+			Status: status,
+			Labels: template.KV{
+				"alertname": "SampleAlert",
+				"severity":  "critical",
+			},
+			Annotations: template.KV{
+				"description": "sample alert used to validate card templates",
+			},
+			StartsAt:     now.Add(-time.Hour),
+			GeneratorURL: "http://prometheus.example.com/graph?g0.expr=up+%3D%3D+0&g0.tab=1",
+			Fingerprint:  "0000000000000000",
+		}
+		card := &LarkCard{
+			Title:       "SampleAlert",
+			Status:      status,
+			Project:     "N/A",
+			Time:        a.StartsAt.Format(time.RFC3339Nano),
+			GrafanaURL:  "N/A",
+			RunBookURL:  "N/A",
+			Metric:      a.GeneratorURL,
+			Description: a.Annotations["description"],
+		}
+		if status == StatusResolved {
+			a.EndsAt = now
+			card.EndsAt = now.Format(time.RFC3339Nano)
+		}
+		samples = append(samples, &CardData{
+			Data: &template.Data{
+				Receiver:          "sample",
+				Status:            status,
+				Alerts:            template.Alerts{a},
+				GroupLabels:       template.KV{"alertname": "SampleAlert"},
+				CommonLabels:      a.Labels,
+				CommonAnnotations: a.Annotations,
+			},
+			GroupKey: "{}:{alertname=\"SampleAlert\"}",
+			Alert:    a,
+			Card:     card,
+		})
+	}
+	return samples
+}
@@ -0,0 +1,165 @@
+package alert
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/config/configtest"
+)
+
+// setTemplates configures the card templates for the duration of the test.
+func setTemplates(t *testing.T, templates ...config.TemplateConfig) *config.Config {
+	t.Helper()
+	cfg := configtest.Set(t)
+	cfg.Templates = templates
+	return cfg
+}
+
+func decode(t *testing.T, card string) map[string]any {
+	t.Helper()
+	var m map[string]any
+	if err := json.Unmarshal([]byte(card), &m); err != nil {
+		t.Fatalf("invalid card json: %v\n%s", err, card)
+	}
+	return m
+}
+
+// elementsTagged returns the top level elements of card with tag.
+func elementsTagged(t *testing.T, card string, tag string) []map[string]any {
+	t.Helper()
+	var out []map[string]any
+	elements, _ := decode(t, card)["elements"].([]any)
+	for _, e := range elements {
+		if m, ok := e.(map[string]any); ok && m["tag"] == tag {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func TestShippedDefaultTemplateMatchesBuiltInCard(t *testing.T) {
+	cfg := setTemplates(t, config.TemplateConfig{Name: "shipped", File: "../../config/templates/default.tmpl"})
+	cfg.Alertmanager.URLs = []string{"http://alertmanager:9093"}
+	templates, err := NewTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range sampleCardData() {
+		for _, variant := range []string{"plain", "acked", "silenced"} {
+			card := *data.Card
+			card.Fingerprint = "0000000000000000"
+			card.GroupKey = data.GroupKey
+			card.Labels = data.Alert.Labels
+			card.AssignEmails = []string{"oncall@example.com"}
+			switch variant {
+			case "acked":
+				card.History = []HistoryEntry{NewHistoryEntry(ActionAcknowledge, "ops", "ou_1")}
+			case "silenced":
+				card.SilenceID = "silence-1"
+				card.SilencedUntil = "2030-01-01 00:00:00"
+				card.History = []HistoryEntry{NewHistoryEntry(ActionSilence, "ops", "ou_1")}
+			}
+			rendered := card
+			got, err := templates.Render("shipped", &CardData{Data: data.Data, Alert: data.Alert, Card: &rendered})
+			if err != nil {
+				t.Fatal(err)
+			}
+			builtIn := card
+			if want := builtIn.Card(); !reflect.DeepEqual(decode(t, got), decode(t, want)) {
+				t.Errorf("%s %s card differs from the built-in card\ngot:  %s\nwant: %s", card.Status, variant, got, want)
+			}
+		}
+	}
+}
+
+func TestTemplatedCardKeepsActions(t *testing.T) {
+	setTemplates(t,
+		config.TemplateConfig{Name: "compact", File: "../../config/templates/compact.tmpl"},
+		config.TemplateConfig{Name: "own-actions", Text: `{"elements": [
+			{"tag": "markdown", "content": "x"},
+			{"tag": "action", "actions": []}
+		]}`},
+	)
+	templates, err := NewTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firing, resolved := sampleCardData()[0], sampleCardData()[1]
+	firing.Card.Fingerprint = "fp"
+	firing.Card.GroupKey = "group"
+
+	card, err := templates.Render("compact", firing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := elementsTagged(t, card, "action")
+	if len(actions) != 1 {
+		t.Fatalf("want one action element, got %d: %s", len(actions), card)
+	}
+	buttons := actions[0]["actions"].([]any)
+	if len(buttons) < 2 {
+		t.Fatalf("want acknowledge and resolve buttons, got %v", buttons)
+	}
+	value := buttons[0].(map[string]any)["value"]
+	want := map[string]any{"fingerprint": "fp", "group_key": "group", "action": ActionAcknowledge}
+	if !reflect.DeepEqual(value, want) {
+		t.Errorf("button value is %v, want %v", value, want)
+	}
+
+	card, err = templates.Render("compact", resolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(elementsTagged(t, card, "action")); n != 0 {
+		t.Errorf("resolved card has %d action elements", n)
+	}
+
+	card, err = templates.Render("own-actions", firing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions := elementsTagged(t, card, "action"); len(actions) != 1 || len(actions[0]["actions"].([]any)) != 0 {
+		t.Errorf("the action element of the template was replaced: %s", card)
+	}
+}
+
+func TestTemplateChecksFollowReceiverMode(t *testing.T) {
+	grouped := config.TemplateConfig{Name: "grouped", Text: `{"header": {"title": {"tag": "plain_text", "content": {{ .Group.Title | toJson }}}}, "elements": []}`}
+	compact := config.TemplateConfig{Name: "compact", File: "../../config/templates/compact.tmpl"}
+	tests := []struct {
+		name      string
+		mode      string
+		template  config.TemplateConfig
+		receivers []config.ReceiverConfig
+		ok        bool
+	}{
+		{"alert template in alert mode", "", compact, nil, true},
+		{"alert template of a grouped receiver", "", compact, []config.ReceiverConfig{{Name: "db", Template: "compact", Mode: ModeGrouped}}, false},
+		{"alert template of a receiver in the grouped card mode", ModeGrouped, compact, []config.ReceiverConfig{{Name: "db", Template: "compact"}}, false},
+		{"alert template of an alert receiver in grouped card mode", ModeGrouped, compact, []config.ReceiverConfig{{Name: "db", Template: "compact", Mode: ModeAlert}}, true},
+		{"grouped template of a grouped receiver", "", grouped, []config.ReceiverConfig{{Name: "db", Template: "grouped", Mode: ModeGrouped}}, true},
+		{"grouped template in grouped card mode", ModeGrouped, grouped, nil, true},
+		{"unused grouped template in alert mode", "", grouped, nil, false},
+		{"grouped template of receivers in both modes", "", grouped, []config.ReceiverConfig{
+			{Name: "db", Template: "grouped", Mode: ModeGrouped},
+			{Name: "web", Template: "grouped"},
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := setTemplates(t, tt.template)
+			cfg.Card.Mode = tt.mode
+			cfg.Receivers = tt.receivers
+			_, err := NewTemplates()
+			if tt.ok && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("mismatched template was accepted")
+			}
+		})
+	}
+}
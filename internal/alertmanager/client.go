@@ -0,0 +1,150 @@
+package alertmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrNotConfigured = errors.New("alertmanager url is not configured")
+
+// Matcher is a silence matcher of the alertmanager v2 api.
+type Matcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual bool   `json:"isEqual"`
+}
+
+// Silence is a postable silence of the alertmanager v2 api.
+type Silence struct {
+	ID        string    `json:"id,omitempty"`
+	Matchers  []Matcher `json:"matchers"`
+	StartsAt  time.Time `json:"startsAt"`
+	EndsAt    time.Time `json:"endsAt"`
+	CreatedBy string    `json:"createdBy"`
+	Comment   string    `json:"comment"`
+}
+
+// Client talks to the alertmanager v2 api. Requests are sent to each of the
+// configured urls in turn until one succeeds, the peers of a cluster share
+// their silences.
+type Client struct {
+	URLs        []string
+	BearerToken string
+	Username    string
+	Password    string
+	HTTPClient  *http.Client
+}
+
+func NewClient() *Client {
+	cfg := config.GlobalConfig.Alertmanager
+	timeout := time.Duration(cfg.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &Client{
+		URLs:        cfg.URLs,
+		BearerToken: cfg.BearerToken,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+		HTTPClient:  &http.Client{Timeout: timeout},
+	}
+}
+
+func (c *Client) Enabled() bool {
+	return c != nil && len(c.URLs) > 0
+}
+
+// MatchersFromLabels builds equal matchers for every non empty label.
+func MatchersFromLabels(labels map[string]string) []Matcher {
+	matchers := make([]Matcher, 0, len(labels))
+	for k, v := range labels {
+		if v == "" {
+			continue
+		}
+		matchers = append(matchers, Matcher{Name: k, Value: v, IsEqual: true})
+	}
+	return matchers
+}
+
+// CreateSilence creates s and returns the id of the silence.
+func (c *Client) CreateSilence(ctx context.Context, s *Silence) (string, error) {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		SilenceID string `json:"silenceID"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/v2/silences", body, &resp); err != nil {
+		return "", err
+	}
+	return resp.SilenceID, nil
+}
+
+// ExpireSilence expires the silence with id.
+func (c *Client) ExpireSilence(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v2/silence/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	if !c.Enabled() {
+		return ErrNotConfigured
+	}
+	var lastErr error
+	for _, base := range c.URLs {
+		lastErr = c.doOne(ctx, method, strings.TrimRight(base, "/")+path, body, out)
+		if lastErr == nil {
+			return nil
+		}
+		log.Warn().Err(lastErr).Msgf("alertmanager request %s %s failed", method, base)
+	}
+	return lastErr
+}
+
+func (c *Client) doOne(ctx context.Context, method, u string, body []byte, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	} else if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("alertmanager returned %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	if out != nil && len(respBody) > 0 {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package alertmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCreateSilenceFailsOver(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	var got Silence
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/prefix/api/v2/silences" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Errorf("unexpected authorization %q", auth)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Write([]byte(`{"silenceID": "s1"}`))
+	}))
+	defer up.Close()
+
+	c := &Client{
+		URLs:        []string{down.URL, up.URL + "/prefix/"},
+		BearerToken: "token",
+		HTTPClient:  http.DefaultClient,
+	}
+	now := time.Now()
+	id, err := c.CreateSilence(context.Background(), &Silence{
+		Matchers:  MatchersFromLabels(map[string]string{"alertname": "DiskFull", "empty": ""}),
+		StartsAt:  now,
+		EndsAt:    now.Add(time.Hour),
+		CreatedBy: "ops",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "s1" {
+		t.Errorf("silence id is %q, want s1", id)
+	}
+	want := Matcher{Name: "alertname", Value: "DiskFull", IsEqual: true}
+	if len(got.Matchers) != 1 || got.Matchers[0] != want || got.CreatedBy != "ops" {
+		t.Errorf("alertmanager received %+v", got)
+	}
+}
+
+func TestExpireSilence(t *testing.T) {
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		if user, pass, ok := r.BasicAuth(); !ok || user != "admin" || pass != "secret" {
+			t.Errorf("unexpected basic auth %q %q", user, pass)
+		}
+		path = r.URL.EscapedPath()
+	}))
+	defer srv.Close()
+
+	c := &Client{URLs: []string{srv.URL}, Username: "admin", Password: "secret", HTTPClient: http.DefaultClient}
+	if err := c.ExpireSilence(context.Background(), "a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if path != "/api/v2/silence/a%2Fb" {
+		t.Errorf("expired %s", path)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	if _, err := (&Client{}).CreateSilence(context.Background(), &Silence{}); !errors.Is(err, ErrNotConfigured) {
+		t.Errorf("want ErrNotConfigured, got %v", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "silence not found", http.StatusNotFound)
+	}))
+	defer srv.Close()
+	c := &Client{URLs: []string{srv.URL}, HTTPClient: http.DefaultClient}
+	if err := c.ExpireSilence(context.Background(), "s1"); err == nil {
+		t.Error("alertmanager error was not returned")
+	}
+}
@@ -0,0 +1,142 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+)
+
+const (
+	StatusOK    = "ok"
+	StatusError = "error"
+)
+
+// Check reports why a component is not healthy.
+type Check func(ctx context.Context) error
+
+// Component is the result of a check.
+type Component struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latency_ms"`
+}
+
+// Report is the result of all readiness or liveness checks, Status is ok
+// when every component is.
+type Report struct {
+	Status     string               `json:"status"`
+	Components map[string]Component `json:"components"`
+	CheckedAt  time.Time            `json:"checked_at"`
+}
+
+type named struct {
+	name  string
+	check Check
+}
+
+// Registry holds the readiness and liveness checks the components register
+// when they are created. Readiness reports are cached as they call out to
+// kafka and lark.
+type Registry struct {
+	timeout  time.Duration
+	cacheTTL time.Duration
+
+	mu        sync.Mutex
+	readiness []named
+	liveness  []named
+	ready     *Report
+}
+
+func NewRegistry() *Registry {
+	timeout := time.Duration(config.GlobalConfig.Health.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &Registry{
+		timeout:  timeout,
+		cacheTTL: time.Duration(config.GlobalConfig.Health.CacheSeconds) * time.Second,
+	}
+}
+
+// Readiness adds a check that must pass before traffic is sent to us.
+func (r *Registry) Readiness(name string, check Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readiness = append(r.readiness, named{name: name, check: check})
+}
+
+// Liveness adds a check that fails when we need to be restarted.
+func (r *Registry) Liveness(name string, check Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.liveness = append(r.liveness, named{name: name, check: check})
+}
+
+func (r *Registry) Ready(ctx context.Context) Report {
+	r.mu.Lock()
+	if r.ready != nil && time.Since(r.ready.CheckedAt) < r.cacheTTL {
+		report := *r.ready
+		r.mu.Unlock()
+		return report
+	}
+	checks := r.readiness
+	r.mu.Unlock()
+
+	report := r.run(ctx, checks)
+	r.mu.Lock()
+	r.ready = &report
+	r.mu.Unlock()
+	return report
+}
+
+func (r *Registry) Live(ctx context.Context) Report {
+	r.mu.Lock()
+	checks := r.liveness
+	r.mu.Unlock()
+	return r.run(ctx, checks)
+}
+
+// run runs checks concurrently, each bounded by the check timeout.
+func (r *Registry) run(ctx context.Context, checks []named) Report {
+	report := Report{
+		Status:     StatusOK,
+		Components: make(map[string]Component, len(checks)),
+		CheckedAt:  time.Now(),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, r.timeout)
+			defer cancel()
+			start := time.Now()
+			// not every client takes a context, a check that doesn't return
+			// in time is reported as failed and left to finish on its own
+			done := make(chan error, 1)
+			go func() { done <- c.check(ctx) }()
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			component := Component{Status: StatusOK, LatencyMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				component.Status = StatusError
+				component.Error = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			report.Components[c.name] = component
+			if err != nil {
+				report.Status = StatusError
+			}
+		}()
+	}
+	wg.Wait()
+	return report
+}
@@ -0,0 +1,87 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config/configtest"
+)
+
+func TestReadyReportsFailingComponents(t *testing.T) {
+	configtest.Set(t)
+	r := NewRegistry()
+	r.Readiness("kafka", func(context.Context) error { return nil })
+	r.Readiness("lark", func(context.Context) error { return errors.New("lark is down") })
+
+	report := r.Ready(context.Background())
+	if report.Status != StatusError {
+		t.Errorf("report is %s with a failing component", report.Status)
+	}
+	if c := report.Components["kafka"]; c.Status != StatusOK {
+		t.Errorf("kafka is %+v", c)
+	}
+	if c := report.Components["lark"]; c.Status != StatusError || c.Error != "lark is down" {
+		t.Errorf("lark is %+v", c)
+	}
+}
+
+func TestReadyIsCached(t *testing.T) {
+	cfg := configtest.Set(t)
+	cfg.Health.CacheSeconds = 60
+	var calls atomic.Int32
+	check := func(context.Context) error {
+		calls.Add(1)
+		return nil
+	}
+	r := NewRegistry()
+	r.Readiness("kafka", check)
+	r.Liveness("consumer", check)
+
+	first := r.Ready(context.Background())
+	second := r.Ready(context.Background())
+	if n := calls.Load(); n != 1 {
+		t.Errorf("readiness was checked %d times within the cache time", n)
+	}
+	if !second.CheckedAt.Equal(first.CheckedAt) {
+		t.Errorf("cached report was checked at %s, want %s", second.CheckedAt, first.CheckedAt)
+	}
+	r.Live(context.Background())
+	r.Live(context.Background())
+	if n := calls.Load(); n != 3 {
+		t.Errorf("liveness was cached, %d checks ran", n)
+	}
+
+	cfg.Health.CacheSeconds = 0
+	r = NewRegistry()
+	r.Readiness("kafka", check)
+	r.Ready(context.Background())
+	r.Ready(context.Background())
+	if n := calls.Load(); n != 5 {
+		t.Errorf("readiness was cached without a cache time, %d checks ran", n)
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	configtest.Set(t)
+	r := NewRegistry()
+	r.timeout = 50 * time.Millisecond
+	release := make(chan struct{})
+	defer close(release)
+	// the check ignores its context like a client without one
+	r.Readiness("lark", func(context.Context) error {
+		<-release
+		return nil
+	})
+
+	start := time.Now()
+	report := r.Ready(context.Background())
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("hung check held the report for %s", elapsed)
+	}
+	if c := report.Components["lark"]; c.Status != StatusError || c.Error != context.DeadlineExceeded.Error() {
+		t.Errorf("hung check is reported as %+v", c)
+	}
+}
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "alertmanager_lark"
+
+var CallbackRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "callback_rejected_total",
+	Help:      "Lark card callbacks rejected by the signature verification, by reason.",
+}, []string{"reason"})
+
+var (
+	SpoolDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spool_depth",
+		Help:      "Records in the disk spool waiting to be flushed to the queue.",
+	})
+	SpoolBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spool_bytes",
+		Help:      "Size of the disk spool in bytes.",
+	})
+	SpoolOldestAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "spool_oldest_age_seconds",
+		Help:      "Age of the oldest record in the disk spool, 0 when empty.",
+	})
+	SpoolRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "spool_records_total",
+		Help:      "Records written to, flushed from or rejected by the disk spool.",
+	}, []string{"result"})
+)
+
+var (
+	WebhookRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_requests_total",
+		Help:      "Alertmanager webhook requests, by route and status code.",
+	}, []string{"route", "code"})
+	WebhookRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_rejected_total",
+		Help:      "Webhooks rejected by the authentication, by reason.",
+	}, []string{"reason"})
+	WebhookPayloadBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "webhook_payload_bytes",
+		Help:      "Size of the alertmanager webhook payloads.",
+		Buckets:   prometheus.ExponentialBuckets(256, 4, 8),
+	}, []string{"route"})
+)
+
+var (
+	QueueWriteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "queue_write_duration_seconds",
+		Help:      "Latency of a single write attempt to the queue.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend"})
+	QueueWriteRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_write_retries_total",
+		Help:      "Queue writes attempted again after a failure.",
+	}, []string{"backend"})
+	QueueWriteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_write_failures_total",
+		Help:      "Webhooks that could not be written to the queue after all retries.",
+	}, []string{"backend"})
+)
+
+var (
+	ConsumerLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "consumer_lag",
+		Help:      "Messages in the queue not fetched by this consumer yet.",
+	})
+	MessageProcessingDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "message_processing_duration_seconds",
+		Help:      "Time from fetching a queue message until it was delivered or dead-lettered, by result.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"result"})
+)
+
+var (
+	LarkAPICalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lark_api_calls_total",
+		Help:      "Lark api calls by method and lark error code, code is \"error\" when the call failed.",
+	}, []string{"method", "code"})
+	LarkAPIDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "lark_api_duration_seconds",
+		Help:      "Latency of lark api calls by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+	CallbackActions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "callback_actions_total",
+		Help:      "Card actions by action and result.",
+	}, []string{"action", "result"})
+	AlertDeliveryLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "alert_delivery_latency_seconds",
+		Help:      "Time from an alert starting, or resolving, until its card was delivered, by status.",
+		Buckets:   []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600},
+	}, []string{"status"})
+)
+
+// ObserveLarkCall records a lark api call started at start.
+func ObserveLarkCall(method string, start time.Time, code int, err error) {
+	LarkAPIDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	label := strconv.Itoa(code)
+	if err != nil {
+		label = "error"
+	}
+	LarkAPICalls.WithLabelValues(method, label).Inc()
+}
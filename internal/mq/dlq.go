@@ -0,0 +1,194 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	kafka "github.com/segmentio/kafka-go"
+	"go.uber.org/fx"
+)
+
+// Stages a message can fail at.
+const (
+	StageDecode  = "decode"
+	StageDeliver = "deliver"
+)
+
+// Headers added to dead letters.
+const (
+	HeaderDLQStage     = "dlq-stage"
+	HeaderDLQError     = "dlq-error"
+	HeaderDLQAttempts  = "dlq-attempts"
+	HeaderDLQTopic     = "dlq-topic"
+	HeaderDLQPartition = "dlq-partition"
+	HeaderDLQOffset    = "dlq-offset"
+	HeaderDLQTime      = "dlq-time"
+)
+
+// DeadLetter describes why a message, or its delivery to one chat, failed.
+type DeadLetter struct {
+	Stage    string
+	ChatID   string
+	Attempts int
+	Err      error
+}
+
+// DLQ publishes messages that can't be delivered to the dead letter topic,
+// it is only available with the kafka queue backend.
+type DLQ struct {
+	Producer Producer
+	Topic    string
+}
+
+func NewDLQ(lc fx.Lifecycle) (*DLQ, error) {
+	backend := config.GlobalConfig.Queue.Backend
+	if config.GlobalConfig.Kafka.DLQTopic == "" || (backend != "" && backend != BackendKafka) ||
+		config.GlobalConfig.Delivery.Mode == DeliveryDirect {
+		return &DLQ{}, nil
+	}
+	p, err := NewKafkaProducer(config.GlobalConfig.Kafka.DLQTopic)
+	if err != nil {
+		return nil, err
+	}
+	p.Writer.RequiredAcks = kafka.RequireAll
+
+	lc.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			return p.Close()
+		},
+	})
+
+	return &DLQ{Producer: p, Topic: config.GlobalConfig.Kafka.DLQTopic}, nil
+}
+
+func (q *DLQ) Enabled() bool {
+	return q != nil && q.Producer != nil
+}
+
+// Publish writes one dead letter of m per letter, all in a single write.
+func (q *DLQ) Publish(ctx context.Context, m Message, letters ...DeadLetter) error {
+	if !q.Enabled() {
+		return errors.New("dead letter topic is not configured")
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	msgs := make([]Message, 0, len(letters))
+	for _, l := range letters {
+		headers := StripDLQHeaders(m.Headers)
+		headers = append(headers,
+			Header{Key: HeaderDLQStage, Value: []byte(l.Stage)},
+			Header{Key: HeaderDLQAttempts, Value: []byte(strconv.Itoa(l.Attempts))},
+			Header{Key: HeaderDLQTopic, Value: []byte(m.Topic)},
+			Header{Key: HeaderDLQPartition, Value: []byte(strconv.Itoa(m.Partition))},
+			Header{Key: HeaderDLQOffset, Value: []byte(strconv.FormatInt(m.Offset, 10))},
+			Header{Key: HeaderDLQTime, Value: []byte(now)},
+		)
+		if l.Err != nil {
+			headers = append(headers, Header{Key: HeaderDLQError, Value: []byte(l.Err.Error())})
+		}
+		if l.ChatID != "" {
+			// a replayed dead letter already carries the chat it failed for
+			headers = SetHeader(headers, HeaderChatID, []byte(l.ChatID))
+		}
+		msgs = append(msgs, Message{
+			Key:     m.Key,
+			Value:   m.Value,
+			Headers: headers,
+		})
+	}
+	if err := q.Producer.Produce(ctx, msgs...); err != nil {
+		return fmt.Errorf("write dead letters to %s: %w", q.Topic, err)
+	}
+	return nil
+}
+
+// StripDLQHeaders returns headers without the ones describing a dead letter,
+// the chat id is kept.
+func StripDLQHeaders(headers []Header) []Header {
+	out := make([]Header, 0, len(headers))
+	for _, h := range headers {
+		if strings.HasPrefix(h.Key, "dlq-") {
+			continue
+		}
+		out = append(out, h)
+	}
+	return out
+}
+
+// ReadDLQ calls fn with every message currently in the dead letter topic,
+// partition by partition. It doesn't use a consumer group, so nothing is
+// committed and the topic can be read again.
+func ReadDLQ(ctx context.Context, fn func(Message) error) error {
+	topic := config.GlobalConfig.Kafka.DLQTopic
+	if topic == "" {
+		return errors.New("dead letter topic is not configured")
+	}
+	brokers := config.GlobalConfig.Kafka.Brokers
+	if len(brokers) == 0 {
+		return errors.New("no kafka brokers configured")
+	}
+
+	dialer, err := NewDialer()
+	if err != nil {
+		return err
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", brokers[0])
+	if err != nil {
+		return fmt.Errorf("dial kafka: %w", err)
+	}
+	partitions, err := conn.ReadPartitions(topic)
+	conn.Close()
+	if err != nil {
+		return fmt.Errorf("read partitions of %s: %w", topic, err)
+	}
+
+	for _, p := range partitions {
+		if err := readPartition(ctx, dialer, brokers, topic, p.ID, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readPartition(ctx context.Context, dialer *kafka.Dialer, brokers []string, topic string, partition int, fn func(Message) error) error {
+	leader, err := dialer.DialLeader(ctx, "tcp", brokers[0], topic, partition)
+	if err != nil {
+		return fmt.Errorf("dial leader of %s/%d: %w", topic, partition, err)
+	}
+	first, last, err := leader.ReadOffsets()
+	leader.Close()
+	if err != nil {
+		return fmt.Errorf("read offsets of %s/%d: %w", topic, partition, err)
+	}
+	if first >= last {
+		return nil
+	}
+
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   brokers,
+		Topic:     topic,
+		Partition: partition,
+		MaxBytes:  config.GlobalConfig.Kafka.MaxBytes,
+		Dialer:    dialer,
+	})
+	defer r.Close()
+	if err := r.SetOffset(first); err != nil {
+		return fmt.Errorf("seek %s/%d: %w", topic, partition, err)
+	}
+	for {
+		m, err := r.ReadMessage(ctx)
+		if err != nil {
+			return fmt.Errorf("read %s/%d: %w", topic, partition, err)
+		}
+		if err := fn(fromKafka(m)); err != nil {
+			return err
+		}
+		if m.Offset >= last-1 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPublishReplacesChatID(t *testing.T) {
+	dead := NewMemoryQueue(10)
+	dlq := &DLQ{Producer: dead, Topic: "dlq"}
+	// a replayed dead letter that failed again
+	m := Message{
+		Value: []byte("{}"),
+		Headers: []Header{
+			{Key: HeaderRoute, Value: []byte("team")},
+			{Key: HeaderChatID, Value: []byte("oc_1")},
+			{Key: HeaderDLQAttempts, Value: []byte("5")},
+		},
+		Topic: "webhook-topic",
+	}
+	err := dlq.Publish(context.Background(), m, DeadLetter{Stage: StageDeliver, ChatID: "oc_1", Attempts: 3, Err: errors.New("failed")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	letter, err := dead.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, h := range letter.Headers {
+		counts[h.Key]++
+	}
+	for _, key := range []string{HeaderChatID, HeaderDLQAttempts, HeaderRoute} {
+		if counts[key] != 1 {
+			t.Errorf("dead letter has %d %s headers: %v", counts[key], key, letter.Headers)
+		}
+	}
+	if v := HeaderValue(letter, HeaderDLQAttempts); v != "3" {
+		t.Errorf("dead letter attempts is %s, want 3", v)
+	}
+}
@@ -0,0 +1,113 @@
+package mq
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// EnvelopeVersion is the newest envelope schema this build writes and
+// reads. Version 0 is the legacy format, the bare webhook message.
+const EnvelopeVersion = 1
+
+// Headers mirroring the envelope metadata, so it can be inspected without
+// decoding the value.
+const (
+	HeaderEnvelopeVersion = "envelope-version"
+	HeaderReceivedAt      = "received-at"
+	HeaderSourceIP        = "source-ip"
+	HeaderRequestID       = "request-id"
+	HeaderBodySHA256      = "body-sha256"
+	HeaderTraceParent     = "traceparent"
+	HeaderTraceState      = "tracestate"
+)
+
+// Envelope wraps a webhook message with where and when it was received.
+type Envelope struct {
+	Version    int       `json:"version"`
+	ReceivedAt time.Time `json:"receivedAt"`
+	SourceIP   string    `json:"sourceIP,omitempty"`
+	Route      string    `json:"route,omitempty"`
+	RequestID  string    `json:"requestID,omitempty"`
+	// TraceParent and TraceState are the w3c trace context of the request.
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
+	// BodySHA256 is the hash of the request body the payload was read from,
+	// the records of a fanned out notification share it.
+	BodySHA256 string          `json:"bodySHA256,omitempty"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+func BodySHA256(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Headers returns the headers mirroring the metadata of e.
+func (e *Envelope) Headers() []Header {
+	headers := []Header{
+		{Key: HeaderEnvelopeVersion, Value: []byte(strconv.Itoa(e.Version))},
+		{Key: HeaderReceivedAt, Value: []byte(e.ReceivedAt.UTC().Format(time.RFC3339Nano))},
+	}
+	for _, h := range []Header{
+		{Key: HeaderRoute, Value: []byte(e.Route)},
+		{Key: HeaderSourceIP, Value: []byte(e.SourceIP)},
+		{Key: HeaderRequestID, Value: []byte(e.RequestID)},
+		{Key: HeaderBodySHA256, Value: []byte(e.BodySHA256)},
+		{Key: HeaderTraceParent, Value: []byte(e.TraceParent)},
+		{Key: HeaderTraceState, Value: []byte(e.TraceState)},
+	} {
+		if len(h.Value) > 0 {
+			headers = append(headers, h)
+		}
+	}
+	return headers
+}
+
+// OpenEnvelope returns the envelope of m. Messages in the legacy format are
+// returned as a version 0 envelope with the value as payload and the route
+// of the route header.
+func OpenEnvelope(m Message) (*Envelope, error) {
+	if v := HeaderValue(m, HeaderEnvelopeVersion); v != "" {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid envelope version %q", v)
+		}
+		if version > 0 {
+			return decodeEnvelope(m.Value)
+		}
+	}
+
+	// the legacy message has a version too, but never a payload
+	var probe struct {
+		Payload json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(m.Value, &probe); err != nil {
+		return nil, err
+	}
+	if len(probe.Payload) > 0 {
+		return decodeEnvelope(m.Value)
+	}
+	return &Envelope{
+		Route:      HeaderValue(m, HeaderRoute),
+		ReceivedAt: m.Time,
+		Payload:    m.Value,
+	}, nil
+}
+
+func decodeEnvelope(value []byte) (*Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(value, &e); err != nil {
+		return nil, err
+	}
+	if e.Version < 1 || e.Version > EnvelopeVersion {
+		return nil, fmt.Errorf("unsupported envelope version %d, newest supported is %d", e.Version, EnvelopeVersion)
+	}
+	if len(e.Payload) == 0 {
+		return nil, fmt.Errorf("envelope has no payload")
+	}
+	return &e, nil
+}
@@ -0,0 +1,67 @@
+package mq
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestOpenEnvelope(t *testing.T) {
+	legacy := []byte(`{"version": "4", "receiver": "team", "status": "firing", "alerts": []}`)
+	received := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	wrapped, err := json.Marshal(&Envelope{
+		Version:    EnvelopeVersion,
+		ReceivedAt: received,
+		Route:      "team",
+		RequestID:  "r1",
+		Payload:    legacy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	future, err := json.Marshal(&Envelope{Version: EnvelopeVersion + 1, Payload: legacy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	versionHeader := func(v string) []Header {
+		return []Header{{Key: HeaderEnvelopeVersion, Value: []byte(v)}}
+	}
+
+	tests := []struct {
+		name    string
+		m       Message
+		version int
+		route   string
+		ok      bool
+	}{
+		{"legacy record", Message{Value: legacy, Headers: []Header{{Key: HeaderRoute, Value: []byte("db")}}, Time: received}, 0, "db", true},
+		{"envelope with version header", Message{Value: wrapped, Headers: versionHeader("1")}, EnvelopeVersion, "team", true},
+		{"envelope without headers", Message{Value: wrapped}, EnvelopeVersion, "team", true},
+		{"future version by header", Message{Value: future, Headers: versionHeader("2")}, 0, "", false},
+		{"future version by payload probe", Message{Value: future}, 0, "", false},
+		{"invalid version header", Message{Value: wrapped, Headers: versionHeader("v1")}, 0, "", false},
+		{"corrupt value", Message{Value: []byte(`{"version": 1, "payload": `)}, 0, "", false},
+		{"corrupt envelope", Message{Value: []byte(`{"payload": "x"`), Headers: versionHeader("1")}, 0, "", false},
+		{"envelope without payload", Message{Value: []byte(`{"version": 1}`), Headers: versionHeader("1")}, 0, "", false},
+	}
+	for _, tt := range tests {
+		e, err := OpenEnvelope(tt.m)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: opened as version %d", tt.name, e.Version)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if e.Version != tt.version || e.Route != tt.route || !e.ReceivedAt.Equal(received) {
+			t.Errorf("%s: opened version %d of route %q received at %s", tt.name, e.Version, e.Route, e.ReceivedAt)
+		}
+		var payload map[string]any
+		if err := json.Unmarshal(e.Payload, &payload); err != nil || payload["receiver"] != "team" {
+			t.Errorf("%s: payload is %s", tt.name, e.Payload)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package mq
+
+import "slices"
+
+const (
+	// HeaderRoute carries the receiver route name the webhook was received on.
+	HeaderRoute = "route"
+	// HeaderChatID limits the delivery of a message to a single chat, it is
+	// set on dead letters and kept when they are replayed.
+	HeaderChatID = "chat-id"
+
+	// Headers of the records a notification is fanned out to, one record
+	// per alert.
+	HeaderGroupKey    = "group-key"
+	HeaderGroupStatus = "group-status"
+	HeaderGroupSize   = "group-size"
+	HeaderAlertIndex  = "alert-index"
+	HeaderFingerprint = "fingerprint"
+)
+
+func HeaderValue(m Message, key string) string {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// SetHeader returns headers with the value of key replaced, or added when
+// headers has none.
+func SetHeader(headers []Header, key string, value []byte) []Header {
+	out := slices.DeleteFunc(slices.Clone(headers), func(h Header) bool {
+		return h.Key == key
+	})
+	return append(out, Header{Key: key, Value: value})
+}
@@ -0,0 +1,121 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/segmentio/kafka-go"
+)
+
+// CheckKafkaTopic connects to the first reachable broker and checks that
+// every partition of topic has a leader.
+func CheckKafkaTopic(ctx context.Context, topic string) error {
+	dialer, err := NewDialer()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, broker := range config.GlobalConfig.Kafka.Brokers {
+		conn, err := dialer.DialContext(ctx, "tcp", broker)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		partitions, err := conn.ReadPartitions(topic)
+		conn.Close()
+		if err != nil {
+			return fmt.Errorf("read partitions of topic %s: %w", topic, err)
+		}
+		if len(partitions) == 0 {
+			return fmt.Errorf("topic %s has no partitions", topic)
+		}
+		for _, p := range partitions {
+			if p.Leader.Host == "" {
+				return fmt.Errorf("partition %d of topic %s has no leader", p.ID, topic)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("no kafka broker is reachable: %w", errors.Join(errs...))
+}
+
+// CheckGroup checks that the consumer group is stable and this consumer was
+// assigned partitions of the topic. Replicas beyond the number of partitions
+// are left idle by the group and not ready.
+func (c *KafkaConsumer) CheckGroup(ctx context.Context) error {
+	transport, err := newTransport()
+	if err != nil {
+		return err
+	}
+	defer transport.CloseIdleConnections()
+	return c.checkGroup(ctx, &kafka.Client{Addr: kafka.TCP(config.GlobalConfig.Kafka.Brokers...), Transport: transport})
+}
+
+func (c *KafkaConsumer) checkGroup(ctx context.Context, client *kafka.Client) error {
+	kc := config.GlobalConfig.Kafka
+	found, err := client.FindCoordinator(ctx, &kafka.FindCoordinatorRequest{
+		Key:     kc.ConsumerGroup,
+		KeyType: kafka.CoordinatorKeyTypeConsumer,
+	})
+	if err != nil {
+		return fmt.Errorf("find coordinator of consumer group %s: %w", kc.ConsumerGroup, err)
+	}
+	if found.Error != nil {
+		return fmt.Errorf("find coordinator of consumer group %s: %w", kc.ConsumerGroup, found.Error)
+	}
+	coordinator := net.JoinHostPort(found.Coordinator.Host, strconv.Itoa(found.Coordinator.Port))
+	resp, err := client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{
+		Addr:     kafka.TCP(coordinator),
+		GroupIDs: []string{kc.ConsumerGroup},
+	})
+	if err != nil {
+		return fmt.Errorf("describe consumer group %s: %w", kc.ConsumerGroup, err)
+	}
+	if len(resp.Groups) == 0 {
+		return fmt.Errorf("consumer group %s not found", kc.ConsumerGroup)
+	}
+	group := resp.Groups[0]
+	if group.Error != nil {
+		return fmt.Errorf("describe consumer group %s: %w", kc.ConsumerGroup, group.Error)
+	}
+	if group.GroupState != "Stable" {
+		return fmt.Errorf("consumer group %s is %s", kc.ConsumerGroup, group.GroupState)
+	}
+	joined := false
+	for _, m := range group.Members {
+		if m.ClientID != c.clientID {
+			continue
+		}
+		joined = true
+		for _, t := range m.MemberAssignments.Topics {
+			if t.Topic == kc.Topic && len(t.Partitions) > 0 {
+				return nil
+			}
+		}
+	}
+	if !joined {
+		return fmt.Errorf("consumer %s is not a member of consumer group %s", c.clientID, kc.ConsumerGroup)
+	}
+	return fmt.Errorf("consumer %s of consumer group %s is not assigned partitions of topic %s", c.clientID, kc.ConsumerGroup, kc.Topic)
+}
+
+// Check checks that redis is reachable and the consumer group exists.
+func (q *RedisQueue) Check(ctx context.Context) error {
+	groups, err := q.Client.XInfoGroups(ctx, q.Stream).Result()
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if g.Name == q.Group {
+			return nil
+		}
+	}
+	return fmt.Errorf("redis stream %s has no group %s", q.Stream, q.Group)
+}
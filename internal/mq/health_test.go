@@ -0,0 +1,87 @@
+package mq
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/404LifeFound/alertmanager-lark/config/configtest"
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol/describegroups"
+	"github.com/segmentio/kafka-go/protocol/findcoordinator"
+)
+
+// coordinator answers the group requests of CheckGroup with group.
+type coordinator struct {
+	group describegroups.ResponseGroup
+}
+
+func (c *coordinator) RoundTrip(ctx context.Context, addr net.Addr, req kafka.Request) (kafka.Response, error) {
+	switch req.(type) {
+	case *findcoordinator.Request:
+		return &findcoordinator.Response{Host: "broker", Port: 9092}, nil
+	default:
+		return &describegroups.Response{Groups: []describegroups.ResponseGroup{c.group}}, nil
+	}
+}
+
+// assignment encodes the consumer protocol assignment of partitions of
+// topic.
+func assignment(topic string, partitions ...int32) []byte {
+	b := binary.BigEndian.AppendUint16(nil, 0)
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(topic)))
+	b = append(b, topic...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(partitions)))
+	for _, p := range partitions {
+		b = binary.BigEndian.AppendUint32(b, uint32(p))
+	}
+	return binary.BigEndian.AppendUint32(b, 0)
+}
+
+func TestCheckGroup(t *testing.T) {
+	cfg := configtest.Set(t)
+	cfg.Kafka.ConsumerGroup = "lark"
+	cfg.Kafka.Topic = "alerts"
+	member := func(clientID string, assigned []byte) describegroups.ResponseGroupMember {
+		return describegroups.ResponseGroupMember{MemberID: clientID + "-1", ClientID: clientID, MemberAssignment: assigned}
+	}
+
+	tests := []struct {
+		name  string
+		group describegroups.ResponseGroup
+		err   string
+	}{
+		{"assigned", describegroups.ResponseGroup{GroupID: "lark", GroupState: "Stable", Members: []describegroups.ResponseGroupMember{
+			member("other", assignment("alerts", 0)),
+			member("self", assignment("alerts", 1, 2)),
+		}}, ""},
+		{"rebalancing", describegroups.ResponseGroup{GroupID: "lark", GroupState: "PreparingRebalance"}, "is PreparingRebalance"},
+		{"not a member", describegroups.ResponseGroup{GroupID: "lark", GroupState: "Stable", Members: []describegroups.ResponseGroupMember{
+			member("other", assignment("alerts", 0, 1)),
+		}}, "not a member"},
+		{"idle replica", describegroups.ResponseGroup{GroupID: "lark", GroupState: "Stable", Members: []describegroups.ResponseGroupMember{
+			member("other", assignment("alerts", 0)),
+			member("self", nil),
+		}}, "not assigned partitions"},
+		{"assigned another topic", describegroups.ResponseGroup{GroupID: "lark", GroupState: "Stable", Members: []describegroups.ResponseGroupMember{
+			member("self", assignment("audit", 0)),
+		}}, "not assigned partitions"},
+	}
+	c := &KafkaConsumer{clientID: "self"}
+	for _, tt := range tests {
+		client := &kafka.Client{Addr: kafka.TCP("broker:9092"), Transport: &coordinator{group: tt.group}}
+		err := c.checkGroup(context.Background(), client)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: want error %q, got %v", tt.name, tt.err, err)
+		}
+	}
+}
@@ -2,42 +2,218 @@ package mq
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/rs/zerolog/log"
 	kafka "github.com/segmentio/kafka-go"
-	"go.uber.org/fx"
 )
 
-func NewKafkaReader(lc fx.Lifecycle) *kafka.Reader {
-	r := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:  config.GlobalConfig.Kafka.Brokers,
-		Topic:    config.GlobalConfig.Kafka.Topic,
-		GroupID:  config.GlobalConfig.Kafka.ConsumerGroup,
-		MaxBytes: config.GlobalConfig.Kafka.MaxBytes,
-	})
+// NewWriter returns a writer of topic on the configured brokers.
+func NewWriter(topic string) (*kafka.Writer, error) {
+	c := config.GlobalConfig.Kafka
+	transport, err := newTransport()
+	if err != nil {
+		return nil, err
+	}
+	compression, err := kafkaCompression(c.Compression)
+	if err != nil {
+		return nil, err
+	}
+	acks, err := kafkaRequiredAcks(c.RequiredAcks)
+	if err != nil {
+		return nil, err
+	}
+	return &kafka.Writer{
+		Addr:         kafka.TCP(c.Brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.LeastBytes{},
+		RequiredAcks: acks,
+		Compression:  compression,
+		BatchSize:    c.BatchSize,
+		BatchTimeout: time.Duration(c.BatchTimeoutMs) * time.Millisecond,
+		BatchBytes:   int64(c.MaxBytes),
+		Transport:    transport,
+	}, nil
+}
 
-	lc.Append(fx.Hook{
-		OnStop: func(context.Context) error {
-			return r.Close()
-		},
-	})
+type KafkaProducer struct {
+	Writer *kafka.Writer
+}
 
-	return r
+func NewKafkaProducer(topic string) (*KafkaProducer, error) {
+	w, err := NewWriter(topic)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaProducer{Writer: w}, nil
 }
 
-func NewKafkaWriter(lc fx.Lifecycle) *kafka.Writer {
-	w := &kafka.Writer{
-		Addr:         kafka.TCP(config.GlobalConfig.Kafka.Brokers...),
-		Topic:        config.GlobalConfig.Kafka.Topic,
-		Balancer:     &kafka.LeastBytes{},
-		RequiredAcks: 1,
+func (p *KafkaProducer) Produce(ctx context.Context, msgs ...Message) error {
+	kmsgs := make([]kafka.Message, 0, len(msgs))
+	for _, m := range msgs {
+		km := toKafka(m)
+		// the writer owns the topic and picks the partition
+		km.Topic, km.Partition, km.Offset = "", 0, 0
+		kmsgs = append(kmsgs, km)
+	}
+	return p.Writer.WriteMessages(ctx, kmsgs...)
+}
+
+func (p *KafkaProducer) Close() error {
+	return p.Writer.Close()
+}
+
+// KafkaConsumer consumes the topic in the configured consumer group. Commits
+// are tracked per partition and written in the background.
+type KafkaConsumer struct {
+	Reader *kafka.Reader
+	// clientID tells the group member of this consumer apart from the
+	// other replicas
+	clientID string
+	offsets  *offsets
+	// lag is the lag of each partition as of the last fetched message
+	lagMu   sync.Mutex
+	lag     map[int]int64
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func NewKafkaConsumer() (*KafkaConsumer, error) {
+	kc := config.GlobalConfig.Kafka
+	dialer, err := NewDialer()
+	if err != nil {
+		return nil, err
 	}
+	host, _ := os.Hostname()
+	dialer.ClientID = fmt.Sprintf("alertmanager-lark-%s-%d", host, os.Getpid())
+	start_offset, err := kafkaStartOffset(kc.StartOffset)
+	if err != nil {
+		return nil, err
+	}
+	c := &KafkaConsumer{
+		Reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers:        kc.Brokers,
+			Topic:          kc.Topic,
+			GroupID:        kc.ConsumerGroup,
+			MaxBytes:       kc.MaxBytes,
+			MinBytes:       kc.MinBytes,
+			MaxWait:        time.Duration(kc.MaxWaitMs) * time.Millisecond,
+			StartOffset:    start_offset,
+			CommitInterval: time.Duration(kc.CommitIntervalMs) * time.Millisecond,
+			Dialer:         dialer,
+		}),
+		clientID: dialer.ClientID,
+		offsets:  newOffsets(),
+		lag:      map[int]int64{},
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go c.commitLoop()
+	return c, nil
+}
 
-	lc.Append(fx.Hook{
-		OnStop: func(context.Context) error {
-			return w.Close()
-		},
+func (c *KafkaConsumer) Fetch(ctx context.Context) (Message, error) {
+	km, err := c.Reader.FetchMessage(ctx)
+	if err != nil {
+		return Message{}, err
+	}
+	m := fromKafka(km)
+	c.offsets.add(m)
+	c.lagMu.Lock()
+	c.lag[km.Partition] = max(km.HighWaterMark-km.Offset-1, 0)
+	c.lagMu.Unlock()
+	return m, nil
+}
+
+// Lag sums the lag of the partitions this consumer has fetched from.
+func (c *KafkaConsumer) Lag(ctx context.Context) (int64, error) {
+	c.lagMu.Lock()
+	defer c.lagMu.Unlock()
+	var lag int64
+	for _, l := range c.lag {
+		lag += l
+	}
+	return lag, nil
+}
+
+func (c *KafkaConsumer) Commit(ctx context.Context, m Message) error {
+	c.offsets.done(m)
+	return nil
+}
+
+// Close commits what is done and closes the reader.
+func (c *KafkaConsumer) Close() error {
+	c.once.Do(func() {
+		close(c.stop)
 	})
+	<-c.stopped
+	return c.Reader.Close()
+}
 
-	return w
+func (c *KafkaConsumer) commitLoop() {
+	defer close(c.stopped)
+	for {
+		select {
+		case <-c.offsets.notify:
+			c.commitReady()
+		case <-c.stop:
+			c.commitReady()
+			return
+		}
+	}
+}
+
+func (c *KafkaConsumer) commitReady() {
+	msgs := c.offsets.take()
+	if len(msgs) == 0 {
+		return
+	}
+	kmsgs := make([]kafka.Message, 0, len(msgs))
+	for _, m := range msgs {
+		kmsgs = append(kmsgs, toKafka(m))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Reader.CommitMessages(ctx, kmsgs...); err != nil {
+		// the messages are delivered again after a rebalance, cards already
+		// sent are updated in place
+		log.Error().Err(err).Msgf("failed to commit %d partitions", len(kmsgs))
+	}
+}
+
+func toKafka(m Message) kafka.Message {
+	headers := make([]kafka.Header, 0, len(m.Headers))
+	for _, h := range m.Headers {
+		headers = append(headers, kafka.Header{Key: h.Key, Value: h.Value})
+	}
+	return kafka.Message{
+		Topic:     m.Topic,
+		Partition: m.Partition,
+		Offset:    m.Offset,
+		Key:       m.Key,
+		Value:     m.Value,
+		Headers:   headers,
+		Time:      m.Time,
+	}
+}
+
+func fromKafka(km kafka.Message) Message {
+	headers := make([]Header, 0, len(km.Headers))
+	for _, h := range km.Headers {
+		headers = append(headers, Header{Key: h.Key, Value: h.Value})
+	}
+	return Message{
+		Key:       km.Key,
+		Value:     km.Value,
+		Headers:   headers,
+		Topic:     km.Topic,
+		Partition: km.Partition,
+		Offset:    km.Offset,
+		Time:      km.Time,
+	}
 }
@@ -0,0 +1,148 @@
+package mq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// SASL mechanisms.
+const (
+	SASLPlain       = "plain"
+	SASLScramSHA256 = "scram-sha-256"
+	SASLScramSHA512 = "scram-sha-512"
+)
+
+// kafkaTLS returns the tls config of the brokers, nil when tls is disabled.
+func kafkaTLS() (*tls.Config, error) {
+	c := config.GlobalConfig.Kafka.TLS
+	if !c.Enabled {
+		return nil, nil
+	}
+	t := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read kafka ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in kafka ca file %s", c.CAFile)
+		}
+		t.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load kafka client certificate: %w", err)
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+	return t, nil
+}
+
+// kafkaSASL returns the sasl mechanism of the brokers, nil when sasl is
+// disabled.
+func kafkaSASL() (sasl.Mechanism, error) {
+	c := config.GlobalConfig.Kafka.SASL
+	switch strings.ToLower(c.Mechanism) {
+	case "":
+		return nil, nil
+	case SASLPlain:
+		return plain.Mechanism{Username: c.Username, Password: c.Password}, nil
+	case SASLScramSHA256:
+		return scram.Mechanism(scram.SHA256, c.Username, c.Password)
+	case SASLScramSHA512:
+		return scram.Mechanism(scram.SHA512, c.Username, c.Password)
+	default:
+		return nil, fmt.Errorf("invalid kafka sasl mechanism %s", c.Mechanism)
+	}
+}
+
+// NewDialer returns a dialer of the brokers for readers and connections.
+func NewDialer() (*kafka.Dialer, error) {
+	t, err := kafkaTLS()
+	if err != nil {
+		return nil, err
+	}
+	mechanism, err := kafkaSASL()
+	if err != nil {
+		return nil, err
+	}
+	return &kafka.Dialer{
+		Timeout:       10 * time.Second,
+		DualStack:     true,
+		TLS:           t,
+		SASLMechanism: mechanism,
+	}, nil
+}
+
+// newTransport returns the transport of the brokers for writers.
+func newTransport() (*kafka.Transport, error) {
+	t, err := kafkaTLS()
+	if err != nil {
+		return nil, err
+	}
+	mechanism, err := kafkaSASL()
+	if err != nil {
+		return nil, err
+	}
+	return &kafka.Transport{
+		DialTimeout: 10 * time.Second,
+		TLS:         t,
+		SASL:        mechanism,
+	}, nil
+}
+
+func kafkaCompression(name string) (kafka.Compression, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return 0, nil
+	case "gzip":
+		return kafka.Gzip, nil
+	case "snappy":
+		return kafka.Snappy, nil
+	case "lz4":
+		return kafka.Lz4, nil
+	case "zstd":
+		return kafka.Zstd, nil
+	default:
+		return 0, fmt.Errorf("invalid kafka compression %s", name)
+	}
+}
+
+func kafkaRequiredAcks(acks int) (kafka.RequiredAcks, error) {
+	switch acks {
+	case -1:
+		return kafka.RequireAll, nil
+	case 0:
+		return kafka.RequireNone, nil
+	case 1:
+		return kafka.RequireOne, nil
+	default:
+		return 0, fmt.Errorf("invalid kafka required acks %d", acks)
+	}
+}
+
+func kafkaStartOffset(name string) (int64, error) {
+	switch strings.ToLower(name) {
+	case "", "first":
+		return kafka.FirstOffset, nil
+	case "last":
+		return kafka.LastOffset, nil
+	default:
+		return 0, fmt.Errorf("invalid kafka start offset %s", name)
+	}
+}
@@ -0,0 +1,198 @@
+package mq
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/config/configtest"
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+func TestKafkaSASL(t *testing.T) {
+	cfg := configtest.Set(t)
+	tests := []struct {
+		mechanism string
+		name      string
+		ok        bool
+	}{
+		{"", "", true},
+		{"plain", "PLAIN", true},
+		{"SCRAM-SHA-256", "SCRAM-SHA-256", true},
+		{"scram-sha-512", "SCRAM-SHA-512", true},
+		{"gssapi", "", false},
+	}
+	for _, tt := range tests {
+		cfg.Kafka.SASL = config.KafkaSASLConfig{Mechanism: tt.mechanism, Username: "user", Password: "password"}
+		m, err := kafkaSASL()
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("mechanism %q was accepted", tt.mechanism)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("mechanism %q: %v", tt.mechanism, err)
+			continue
+		}
+		if tt.name == "" {
+			if m != nil {
+				t.Errorf("sasl is enabled without a mechanism: %s", m.Name())
+			}
+			continue
+		}
+		if m == nil || m.Name() != tt.name {
+			t.Errorf("mechanism %q gives %v, want %s", tt.mechanism, m, tt.name)
+		}
+	}
+	cfg.Kafka.SASL.Mechanism = "plain"
+	if m, _ := kafkaSASL(); m != (plain.Mechanism{Username: "user", Password: "password"}) {
+		t.Errorf("plain mechanism lost its credentials: %+v", m)
+	}
+}
+
+func TestKafkaCompression(t *testing.T) {
+	tests := []struct {
+		name string
+		want kafka.Compression
+		ok   bool
+	}{
+		{"", 0, true},
+		{"none", 0, true},
+		{"gzip", kafka.Gzip, true},
+		{"Snappy", kafka.Snappy, true},
+		{"lz4", kafka.Lz4, true},
+		{"zstd", kafka.Zstd, true},
+		{"brotli", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := kafkaCompression(tt.name)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("compression %q: got %v, %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestKafkaRequiredAcks(t *testing.T) {
+	tests := []struct {
+		acks int
+		want kafka.RequiredAcks
+		ok   bool
+	}{
+		{-1, kafka.RequireAll, true},
+		{0, kafka.RequireNone, true},
+		{1, kafka.RequireOne, true},
+		{2, 0, false},
+		{-2, 0, false},
+	}
+	for _, tt := range tests {
+		got, err := kafkaRequiredAcks(tt.acks)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("required acks %d: got %v, %v", tt.acks, got, err)
+		}
+	}
+}
+
+func TestKafkaStartOffset(t *testing.T) {
+	tests := []struct {
+		name string
+		want int64
+		ok   bool
+	}{
+		{"", kafka.FirstOffset, true},
+		{"first", kafka.FirstOffset, true},
+		{"Last", kafka.LastOffset, true},
+		{"newest", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := kafkaStartOffset(tt.name)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("start offset %q: got %d, %v", tt.name, got, err)
+		}
+	}
+}
+
+// writeCert writes a self-signed certificate and its key to dir.
+func writeCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kafka"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestKafkaTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir)
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := configtest.Set(t)
+	cfg.Kafka.TLS.CAFile = certFile
+	if c, err := kafkaTLS(); c != nil || err != nil {
+		t.Errorf("tls is configured while disabled: %v, %v", c, err)
+	}
+
+	cfg.Kafka.TLS.Enabled = true
+	cfg.Kafka.TLS.CertFile, cfg.Kafka.TLS.KeyFile = certFile, keyFile
+	c, err := kafkaTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.RootCAs == nil || len(c.Certificates) != 1 || c.MinVersion != tls.VersionTLS12 {
+		t.Errorf("tls config misses the ca or client certificate: %+v", c)
+	}
+
+	for name, set := range map[string]func(){
+		"missing ca file":         func() { cfg.Kafka.TLS.CAFile = filepath.Join(dir, "missing.pem") },
+		"ca file without ca":      func() { cfg.Kafka.TLS.CAFile = empty },
+		"certificate without key": func() { cfg.Kafka.TLS.KeyFile = "" },
+		"key of another file":     func() { cfg.Kafka.TLS.KeyFile = certFile },
+	} {
+		cfg.Kafka.TLS.CAFile, cfg.Kafka.TLS.CertFile, cfg.Kafka.TLS.KeyFile = certFile, certFile, keyFile
+		set()
+		if _, err := kafkaTLS(); err == nil {
+			t.Errorf("%s was accepted", name)
+		}
+		if _, err := NewDialer(); err == nil {
+			t.Errorf("dialer was created with %s", name)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueClosed = errors.New("queue is closed")
+	ErrQueueFull   = errors.New("queue is full")
+)
+
+// MemoryQueue is an in-process queue for single binary deployments. Messages
+// are lost when the process exits, commits are no-ops.
+type MemoryQueue struct {
+	messages chan Message
+	closed   chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	offset   int64
+	// reject makes Produce fail with ErrQueueFull instead of waiting
+	reject bool
+}
+
+func NewMemoryQueue(size int) *MemoryQueue {
+	if size <= 0 {
+		size = 1000
+	}
+	return &MemoryQueue{
+		messages: make(chan Message, size),
+		closed:   make(chan struct{}),
+	}
+}
+
+// NewDirectQueue returns the queue of direct delivery, it rejects messages
+// while full so the webhook can push back on alertmanager.
+func NewDirectQueue(size int) *MemoryQueue {
+	q := NewMemoryQueue(size)
+	q.reject = true
+	return q
+}
+
+// Produce blocks while the queue is full until ctx is done, a rejecting
+// queue returns ErrQueueFull unless all msgs fit.
+func (q *MemoryQueue) Produce(ctx context.Context, msgs ...Message) error {
+	// hold the lock so the messages keep their order and offsets
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.reject && cap(q.messages)-len(q.messages) < len(msgs) {
+		return ErrQueueFull
+	}
+	for _, m := range msgs {
+		m.Topic, m.Partition, m.Offset = BackendMemory, 0, q.offset
+		if m.Time.IsZero() {
+			m.Time = time.Now()
+		}
+		select {
+		case q.messages <- m:
+			q.offset++
+		case <-q.closed:
+			return ErrQueueClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (q *MemoryQueue) Fetch(ctx context.Context) (Message, error) {
+	select {
+	case m := <-q.messages:
+		return m, nil
+	case <-q.closed:
+		return Message{}, ErrQueueClosed
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+func (q *MemoryQueue) Lag(ctx context.Context) (int64, error) {
+	return int64(len(q.messages)), nil
+}
+
+func (q *MemoryQueue) Commit(ctx context.Context, m Message) error {
+	return nil
+}
+
+func (q *MemoryQueue) Close() error {
+	q.once.Do(func() {
+		close(q.closed)
+	})
+	return nil
+}
@@ -0,0 +1,85 @@
+package mq
+
+import (
+	"sort"
+	"sync"
+)
+
+// offsets tracks the fetched messages of every partition. Messages finish
+// out of order, a partition is only committed up to the last message whose
+// predecessors are all done.
+type offsets struct {
+	mu         sync.Mutex
+	partitions map[int][]*inflight
+	ready      map[int]Message
+	notify     chan struct{}
+}
+
+type inflight struct {
+	m    Message
+	done bool
+}
+
+func newOffsets() *offsets {
+	return &offsets{
+		partitions: map[int][]*inflight{},
+		ready:      map[int]Message{},
+		notify:     make(chan struct{}, 1),
+	}
+}
+
+// add registers a fetched message, it must be called in fetch order.
+func (o *offsets) add(m Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	pending := o.partitions[m.Partition]
+	if n := len(pending); n > 0 && pending[n-1].m.Offset >= m.Offset {
+		// the partition was reassigned and is consumed again from its last
+		// commit, the messages in flight are fetched again
+		pending = nil
+		delete(o.ready, m.Partition)
+	}
+	o.partitions[m.Partition] = append(pending, &inflight{m: m})
+}
+
+// done marks m handled and makes its partition committable as far as it
+// can. Messages that are no longer tracked are ignored.
+func (o *offsets) done(m Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	pending := o.partitions[m.Partition]
+	i := sort.Search(len(pending), func(i int) bool {
+		return pending[i].m.Offset >= m.Offset
+	})
+	if i == len(pending) || pending[i].m.Offset != m.Offset {
+		return
+	}
+	pending[i].done = true
+
+	var last *inflight
+	for len(pending) > 0 && pending[0].done {
+		last = pending[0]
+		pending = pending[1:]
+	}
+	o.partitions[m.Partition] = pending
+	if last == nil {
+		return
+	}
+	o.ready[m.Partition] = last.m
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the messages to commit, one per partition.
+func (o *offsets) take() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	msgs := make([]Message, 0, len(o.ready))
+	for p, m := range o.ready {
+		msgs = append(msgs, m)
+		delete(o.ready, p)
+	}
+	return msgs
+}
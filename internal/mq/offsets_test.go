@@ -0,0 +1,81 @@
+package mq
+
+import (
+	"sort"
+	"testing"
+)
+
+func offsetMessage(partition int, offset int64) Message {
+	return Message{Partition: partition, Offset: offset}
+}
+
+// committable returns the offset taken for each partition.
+func committable(o *offsets) map[int]int64 {
+	out := map[int]int64{}
+	for _, m := range o.take() {
+		out[m.Partition] = m.Offset
+	}
+	return out
+}
+
+func TestOffsetsCommitContiguously(t *testing.T) {
+	o := newOffsets()
+	for i := int64(10); i < 14; i++ {
+		o.add(offsetMessage(0, i))
+	}
+	o.add(offsetMessage(1, 5))
+
+	o.done(offsetMessage(0, 12))
+	o.done(offsetMessage(0, 11))
+	if got := committable(o); len(got) != 0 {
+		t.Fatalf("committable before the first message is done: %v", got)
+	}
+	o.done(offsetMessage(0, 10))
+	o.done(offsetMessage(1, 5))
+	if got := committable(o); got[0] != 12 || got[1] != 5 || len(got) != 2 {
+		t.Errorf("want partition 0 at 12 and 1 at 5, got %v", got)
+	}
+	if got := committable(o); len(got) != 0 {
+		t.Errorf("offsets were taken twice: %v", got)
+	}
+
+	o.done(offsetMessage(0, 13))
+	if got := committable(o); got[0] != 13 {
+		t.Errorf("want partition 0 at 13, got %v", got)
+	}
+	// unknown messages are ignored
+	o.done(offsetMessage(0, 13))
+	o.done(offsetMessage(2, 1))
+	if got := committable(o); len(got) != 0 {
+		t.Errorf("untracked messages became committable: %v", got)
+	}
+}
+
+func TestOffsetsResetOnReassignment(t *testing.T) {
+	o := newOffsets()
+	for i := int64(0); i < 3; i++ {
+		o.add(offsetMessage(0, i))
+	}
+	o.done(offsetMessage(0, 1))
+
+	// the partition is consumed again from its last commit
+	o.add(offsetMessage(0, 0))
+	o.done(offsetMessage(0, 2))
+	if got := committable(o); len(got) != 0 {
+		t.Fatalf("messages of the previous assignment became committable: %v", got)
+	}
+	o.done(offsetMessage(0, 0))
+	if got := committable(o); got[0] != 0 {
+		t.Errorf("want partition 0 at 0, got %v", got)
+	}
+
+	o.add(offsetMessage(0, 1))
+	o.add(offsetMessage(1, 7))
+	o.done(offsetMessage(0, 1))
+	o.done(offsetMessage(1, 7))
+	got := o.take()
+	sort.Slice(got, func(i, j int) bool { return got[i].Partition < got[j].Partition })
+	if len(got) != 2 || got[0].Offset != 1 || got[1].Offset != 7 {
+		t.Errorf("want offsets 1 and 7, got %+v", got)
+	}
+}
@@ -0,0 +1,143 @@
+package mq
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/internal/health"
+	"go.uber.org/fx"
+)
+
+// Queue backends.
+const (
+	BackendKafka  = "kafka"
+	BackendMemory = "memory"
+	BackendWAL    = "wal"
+	BackendRedis  = "redis"
+)
+
+var Backends = []string{BackendKafka, BackendMemory, BackendWAL, BackendRedis}
+
+// Delivery modes, queued delivery goes through the queue backend while
+// direct delivery hands notifications from the webhook to the workers in
+// process.
+const (
+	DeliveryQueue  = "queue"
+	DeliveryDirect = "direct"
+)
+
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Message is a record of the queue. Topic, Partition, Offset and ID tell
+// where a consumed message came from, they are ignored when producing.
+type Message struct {
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+	Topic     string
+	Partition int
+	Offset    int64
+	// ID is set by backends whose messages aren't addressed by offset.
+	ID   string
+	Time time.Time
+}
+
+// Position describes where m was consumed from for logs.
+func (m Message) Position() string {
+	if m.ID != "" {
+		return fmt.Sprintf("%s/%s", m.Topic, m.ID)
+	}
+	return fmt.Sprintf("%s/%d/%d", m.Topic, m.Partition, m.Offset)
+}
+
+type Producer interface {
+	Produce(ctx context.Context, msgs ...Message) error
+	Close() error
+}
+
+// Consumer hands out messages until they are committed. Messages may be
+// committed in any order, a message that is never committed is consumed
+// again after a restart.
+type Consumer interface {
+	Fetch(ctx context.Context) (Message, error)
+	Commit(ctx context.Context, m Message) error
+	Close() error
+}
+
+// LagReporter is implemented by consumers that know how many messages of the
+// queue they have not fetched yet.
+type LagReporter interface {
+	Lag(ctx context.Context) (int64, error)
+}
+
+// NewQueue returns the producer and consumer of the configured backend and
+// registers the readiness checks of the backend.
+func NewQueue(lc fx.Lifecycle, registry *health.Registry) (Producer, Consumer, error) {
+	var (
+		p Producer
+		c Consumer
+		// shared backends produce and consume through the same value
+		shared = true
+	)
+	backend := config.GlobalConfig.Queue.Backend
+	if config.GlobalConfig.Delivery.Mode == DeliveryDirect {
+		backend = DeliveryDirect
+	}
+	switch backend {
+	case DeliveryDirect:
+		q := NewDirectQueue(config.GlobalConfig.Delivery.QueueSize)
+		p, c = q, q
+	case "", BackendKafka:
+		kp, err := NewKafkaProducer(config.GlobalConfig.Kafka.Topic)
+		if err != nil {
+			return nil, nil, err
+		}
+		kc, err := NewKafkaConsumer()
+		if err != nil {
+			kp.Close()
+			return nil, nil, err
+		}
+		p, c, shared = kp, kc, false
+		registry.Readiness("kafka", func(ctx context.Context) error {
+			return CheckKafkaTopic(ctx, config.GlobalConfig.Kafka.Topic)
+		})
+		registry.Readiness("consumer_group", kc.CheckGroup)
+	case BackendMemory:
+		q := NewMemoryQueue(config.GlobalConfig.Queue.MemorySize)
+		p, c = q, q
+	case BackendWAL:
+		q, err := OpenWAL(config.GlobalConfig.Queue.WAL.Path, config.GlobalConfig.Queue.WAL.SegmentBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		p, c = q, q
+	case BackendRedis:
+		q, err := NewRedisQueue()
+		if err != nil {
+			return nil, nil, err
+		}
+		p, c = q, q
+		registry.Readiness("redis", q.Check)
+	default:
+		return nil, nil, fmt.Errorf("invalid queue backend %s", config.GlobalConfig.Queue.Backend)
+	}
+
+	lc.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			// the consumer commits what was delivered while closing
+			if err := c.Close(); err != nil {
+				return err
+			}
+			if shared {
+				return nil
+			}
+			return p.Close()
+		},
+	})
+	return p, c, nil
+}
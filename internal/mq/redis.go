@@ -0,0 +1,371 @@
+package mq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	redisFieldKey     = "key"
+	redisFieldValue   = "value"
+	redisFieldHeaders = "headers"
+	redisFieldTime    = "time"
+	// redisBlock bounds a blocking read so a cancelled ctx is noticed.
+	redisBlock      = 5 * time.Second
+	redisClaimCount = 100
+)
+
+// RedisQueue is a queue on a redis stream read by a consumer group. Entries
+// pending on a consumer that stopped are claimed by the others once they
+// have been idle for ClaimIdle, committed entries are acknowledged and the
+// stream is trimmed to about MaxLen entries. A running consumer keeps the
+// entries it is still delivering from going idle.
+type RedisQueue struct {
+	Client    redis.UniversalClient
+	Stream    string
+	Group     string
+	Consumer  string
+	MaxLen    int64
+	ClaimIdle time.Duration
+
+	mu        sync.Mutex
+	buffered  []Message
+	ownCursor string
+	lastClaim time.Time
+	// inflight are the fetched entries not committed yet, they are touched
+	// every ClaimIdle/3 so other consumers don't claim them while they are
+	// retried
+	inflightMu sync.Mutex
+	inflight   map[string]struct{}
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+func NewRedisQueue() (*RedisQueue, error) {
+	c := config.GlobalConfig.Queue.Redis
+	consumer := c.Consumer
+	if consumer == "" {
+		consumer, _ = os.Hostname()
+	}
+	claim_idle := time.Duration(c.ClaimIdleSeconds) * time.Second
+	if claim_idle <= 0 {
+		claim_idle = 5 * time.Minute
+	}
+	q := &RedisQueue{
+		Client: redis.NewUniversalClient(&redis.UniversalOptions{
+			Addrs:    c.Addrs,
+			Username: c.Username,
+			Password: c.Password,
+			DB:       c.DB,
+		}),
+		Stream:    c.Stream,
+		Group:     c.Group,
+		Consumer:  consumer,
+		MaxLen:    c.MaxLen,
+		ClaimIdle: claim_idle,
+		ownCursor: "0",
+		inflight:  map[string]struct{}{},
+		stop:      make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := q.createGroup(ctx); err != nil {
+		q.Client.Close()
+		return nil, err
+	}
+	go q.keepAlive()
+	return q, nil
+}
+
+// keepAlive touches the inflight entries until the queue is closed.
+func (q *RedisQueue) keepAlive() {
+	ticker := time.NewTicker(q.ClaimIdle / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), redisBlock)
+		if err := q.touch(ctx); err != nil {
+			log.Warn().Err(err).Msgf("failed to touch the pending entries of stream %s", q.Stream)
+		}
+		cancel()
+	}
+}
+
+// touch resets the idle time of the inflight entries by claiming them for
+// this consumer again.
+func (q *RedisQueue) touch(ctx context.Context) error {
+	q.inflightMu.Lock()
+	ids := make([]string, 0, len(q.inflight))
+	for id := range q.inflight {
+		ids = append(ids, id)
+	}
+	q.inflightMu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	return q.Client.XClaimJustID(ctx, &redis.XClaimArgs{
+		Stream:   q.Stream,
+		Group:    q.Group,
+		Consumer: q.Consumer,
+		Messages: ids,
+	}).Err()
+}
+
+// createGroup creates the stream and its consumer group, the group reads
+// the stream from the start so entries added before it are delivered too.
+func (q *RedisQueue) createGroup(ctx context.Context) error {
+	err := q.Client.XGroupCreateMkStream(ctx, q.Stream, q.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("create consumer group %s of stream %s: %w", q.Group, q.Stream, err)
+	}
+	return nil
+}
+
+func (q *RedisQueue) Produce(ctx context.Context, msgs ...Message) error {
+	pipe := q.Client.Pipeline()
+	for _, m := range msgs {
+		headers, err := json.Marshal(m.Headers)
+		if err != nil {
+			return err
+		}
+		t := m.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+		args := &redis.XAddArgs{
+			Stream: q.Stream,
+			Values: []any{
+				redisFieldKey, m.Key,
+				redisFieldValue, m.Value,
+				redisFieldHeaders, headers,
+				redisFieldTime, t.Format(time.RFC3339Nano),
+			},
+		}
+		if q.MaxLen > 0 {
+			args.MaxLen = q.MaxLen
+			args.Approx = true
+		}
+		pipe.XAdd(ctx, args)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Fetch returns the entries still pending on this consumer from before a
+// restart first, then entries claimed from stopped consumers and new ones.
+func (q *RedisQueue) Fetch(ctx context.Context) (Message, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if len(q.buffered) > 0 {
+			m := q.buffered[0]
+			q.buffered = q.buffered[1:]
+			q.inflightMu.Lock()
+			q.inflight[m.ID] = struct{}{}
+			q.inflightMu.Unlock()
+			return m, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return Message{}, err
+		}
+
+		if q.ownCursor != "" {
+			msgs, last, err := q.read(ctx, q.ownCursor, -1)
+			if err != nil {
+				return Message{}, err
+			}
+			q.buffered = msgs
+			q.ownCursor = last
+			continue
+		}
+		if time.Since(q.lastClaim) >= q.ClaimIdle/2 {
+			msgs, err := q.claim(ctx)
+			if err != nil {
+				return Message{}, err
+			}
+			q.lastClaim = time.Now()
+			if len(msgs) > 0 {
+				q.buffered = msgs
+				continue
+			}
+		}
+
+		msgs, _, err := q.read(ctx, ">", redisBlock)
+		if err != nil {
+			return Message{}, err
+		}
+		q.buffered = msgs
+	}
+}
+
+// read reads entries of the group, ">" reads new entries and any other id
+// the ones pending on this consumer after it. It returns the id of the last
+// entry read, trimmed ones included, or "" when there was none.
+func (q *RedisQueue) read(ctx context.Context, id string, block time.Duration) ([]Message, string, error) {
+	streams, err := q.Client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    q.Group,
+		Consumer: q.Consumer,
+		Streams:  []string{q.Stream, id},
+		Count:    redisClaimCount,
+		Block:    block,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("read stream %s: %w", q.Stream, err)
+	}
+	var msgs []Message
+	var lost []string
+	last := ""
+	for _, s := range streams {
+		for _, x := range s.Messages {
+			last = x.ID
+			if trimmed(x) {
+				lost = append(lost, x.ID)
+				continue
+			}
+			msgs = append(msgs, q.message(x))
+		}
+	}
+	if err := q.drop(ctx, lost); err != nil {
+		return nil, "", err
+	}
+	return msgs, last, nil
+}
+
+// claim takes over the entries pending on other consumers for longer than
+// ClaimIdle, running consumers touch theirs well before.
+func (q *RedisQueue) claim(ctx context.Context) ([]Message, error) {
+	var msgs []Message
+	start := "0-0"
+	for {
+		xs, next, err := q.Client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   q.Stream,
+			Group:    q.Group,
+			Consumer: q.Consumer,
+			MinIdle:  q.ClaimIdle,
+			Start:    start,
+			Count:    redisClaimCount,
+		}).Result()
+		if err != nil {
+			return nil, fmt.Errorf("claim pending entries of stream %s: %w", q.Stream, err)
+		}
+		var lost []string
+		for _, x := range xs {
+			if trimmed(x) {
+				lost = append(lost, x.ID)
+				continue
+			}
+			q.inflightMu.Lock()
+			_, fetched := q.inflight[x.ID]
+			q.inflightMu.Unlock()
+			if fetched {
+				continue
+			}
+			log.Warn().Msgf("claimed pending entry %s of stream %s", x.ID, q.Stream)
+			msgs = append(msgs, q.message(x))
+		}
+		if err := q.drop(ctx, lost); err != nil {
+			return nil, err
+		}
+		if next == "0-0" || next == "" {
+			return msgs, nil
+		}
+		start = next
+	}
+}
+
+// trimmed reports whether x was trimmed from the stream while it was
+// pending, redis returns its id without fields then.
+func trimmed(x redis.XMessage) bool {
+	_, ok := x.Values[redisFieldValue]
+	return !ok
+}
+
+// drop acknowledges the pending entries that were trimmed from the stream,
+// they can't be delivered anymore.
+func (q *RedisQueue) drop(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	log.Warn().Msgf("pending entries %s were trimmed from stream %s before they were delivered, maxLen is below the backlog", strings.Join(ids, ", "), q.Stream)
+	if err := q.Client.XAck(ctx, q.Stream, q.Group, ids...).Err(); err != nil {
+		return fmt.Errorf("acknowledge trimmed entries of stream %s: %w", q.Stream, err)
+	}
+	return nil
+}
+
+func (q *RedisQueue) message(x redis.XMessage) Message {
+	m := Message{
+		Topic: q.Stream,
+		ID:    x.ID,
+	}
+	if v, ok := x.Values[redisFieldKey].(string); ok {
+		m.Key = []byte(v)
+	}
+	if v, ok := x.Values[redisFieldValue].(string); ok {
+		m.Value = []byte(v)
+	}
+	if v, ok := x.Values[redisFieldHeaders].(string); ok && v != "" {
+		if err := json.Unmarshal([]byte(v), &m.Headers); err != nil {
+			log.Warn().Err(err).Msgf("invalid headers of entry %s of stream %s", x.ID, q.Stream)
+		}
+	}
+	if v, ok := x.Values[redisFieldTime].(string); ok {
+		m.Time, _ = time.Parse(time.RFC3339Nano, v)
+	}
+	return m
+}
+
+// Commit acknowledges the entry of m, entries are independent so the order
+// doesn't matter.
+func (q *RedisQueue) Commit(ctx context.Context, m Message) error {
+	if err := q.Client.XAck(ctx, q.Stream, q.Group, m.ID).Err(); err != nil {
+		return err
+	}
+	q.inflightMu.Lock()
+	delete(q.inflight, m.ID)
+	q.inflightMu.Unlock()
+	return nil
+}
+
+// Lag is the number of entries not delivered to the group yet, as reported
+// by redis 7 and later.
+func (q *RedisQueue) Lag(ctx context.Context) (int64, error) {
+	groups, err := q.Client.XInfoGroups(ctx, q.Stream).Result()
+	if err != nil {
+		return 0, err
+	}
+	for _, g := range groups {
+		if g.Name == q.Group {
+			if g.Lag < 0 {
+				return 0, fmt.Errorf("redis does not report the lag of group %s", q.Group)
+			}
+			return g.Lag, nil
+		}
+	}
+	return 0, fmt.Errorf("redis stream %s has no group %s", q.Stream, q.Group)
+}
+
+func (q *RedisQueue) Close() error {
+	q.stopOnce.Do(func() {
+		close(q.stop)
+	})
+	return q.Client.Close()
+}
@@ -0,0 +1,170 @@
+package mq
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/config/configtest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedisQueue returns a queue of consumer on the stream of srv.
+func newTestRedisQueue(t *testing.T, srv *miniredis.Miniredis, consumer string, maxLen int64) *RedisQueue {
+	t.Helper()
+	configtest.Set(t).Queue.Redis = config.RedisQueueConfig{
+		Addrs:            []string{srv.Addr()},
+		Stream:           "webhook",
+		Group:            "lark",
+		Consumer:         consumer,
+		MaxLen:           maxLen,
+		ClaimIdleSeconds: 60,
+	}
+	q, err := NewRedisQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+func produce(t *testing.T, q *RedisQueue, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		m := Message{
+			Key:     []byte(fmt.Sprintf("k%d", i)),
+			Value:   []byte(fmt.Sprintf("v%d", i)),
+			Headers: []Header{{Key: HeaderRoute, Value: []byte("team")}},
+		}
+		if err := q.Produce(context.Background(), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func fetch(t *testing.T, q *RedisQueue, n int) []Message {
+	t.Helper()
+	msgs := make([]Message, 0, n)
+	for len(msgs) < n {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		m, err := q.Fetch(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("fetch %d of %d: %v", len(msgs)+1, n, err)
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+func pending(t *testing.T, q *RedisQueue) map[string]int64 {
+	t.Helper()
+	p, err := q.Client.XPending(context.Background(), q.Stream, q.Group).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Consumers
+}
+
+func TestRedisQueueDeliversAndAcknowledges(t *testing.T) {
+	srv := miniredis.RunT(t)
+	q := newTestRedisQueue(t, srv, "a", 0)
+	produce(t, q, 3)
+
+	msgs := fetch(t, q, 3)
+	for i, m := range msgs {
+		if string(m.Key) != fmt.Sprintf("k%d", i) || string(m.Value) != fmt.Sprintf("v%d", i) {
+			t.Errorf("entry %d is %s=%s", i, m.Key, m.Value)
+		}
+		if HeaderValue(m, HeaderRoute) != "team" || m.ID == "" || m.Time.IsZero() {
+			t.Errorf("entry %d lost its metadata: %+v", i, m)
+		}
+	}
+	if err := q.Commit(context.Background(), msgs[1]); err != nil {
+		t.Fatal(err)
+	}
+	if p := pending(t, q); p["a"] != 2 {
+		t.Errorf("want 2 entries pending on a, got %v", p)
+	}
+
+	// a restarted consumer gets its pending entries again
+	restarted := newTestRedisQueue(t, srv, "a", 0)
+	again := fetch(t, restarted, 2)
+	if again[0].ID != msgs[0].ID || again[1].ID != msgs[2].ID {
+		t.Errorf("restarted consumer fetched %s and %s, want %s and %s", again[0].ID, again[1].ID, msgs[0].ID, msgs[2].ID)
+	}
+}
+
+func TestRedisQueueReclaimsOnlyFromStoppedConsumers(t *testing.T) {
+	srv := miniredis.RunT(t)
+	now := time.Now()
+	srv.SetTime(now)
+	a := newTestRedisQueue(t, srv, "a", 0)
+	b := newTestRedisQueue(t, srv, "b", 0)
+	produce(t, a, 2)
+	fetch(t, a, 2)
+
+	// a is still retrying its entries and touches them
+	srv.SetTime(now.Add(2 * time.Minute))
+	if err := a.touch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err := b.claim(context.Background()); err != nil || len(msgs) != 0 {
+		t.Fatalf("b claimed %d entries of a running consumer, err: %v", len(msgs), err)
+	}
+
+	// a stopped, its entries go idle
+	srv.SetTime(now.Add(4 * time.Minute))
+	msgs, err := b.claim(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("b claimed %d entries of a stopped consumer, want 2", len(msgs))
+	}
+	if p := pending(t, b); p["b"] != 2 || p["a"] != 0 {
+		t.Errorf("entries are pending on %v, want all on b", p)
+	}
+}
+
+func TestRedisQueueTrimsStream(t *testing.T) {
+	srv := miniredis.RunT(t)
+	q := newTestRedisQueue(t, srv, "a", 5)
+	produce(t, q, 20)
+
+	n, err := q.Client.XLen(context.Background(), q.Stream).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > 5 {
+		t.Errorf("stream has %d entries, want at most 5", n)
+	}
+	msgs := fetch(t, q, int(n))
+	if last := msgs[len(msgs)-1]; string(last.Key) != "k19" {
+		t.Errorf("newest entry is %s, want k19", last.Key)
+	}
+}
+
+func TestRedisQueueDropsTrimmedPendingEntries(t *testing.T) {
+	srv := miniredis.RunT(t)
+	q := newTestRedisQueue(t, srv, "a", 0)
+	produce(t, q, 2)
+	fetched := fetch(t, q, 2)
+
+	// redis returns pending entries trimmed from the stream without fields
+	if !trimmed(redis.XMessage{ID: fetched[0].ID}) {
+		t.Error("entry without fields is not reported trimmed")
+	}
+	if trimmed(redis.XMessage{ID: fetched[0].ID, Values: map[string]any{redisFieldValue: ""}}) {
+		t.Error("entry with an empty value is reported trimmed")
+	}
+	if err := q.drop(context.Background(), []string{fetched[0].ID}); err != nil {
+		t.Fatal(err)
+	}
+	if p := pending(t, q); p["a"] != 1 {
+		t.Errorf("want the dropped entry acknowledged, pending: %v", p)
+	}
+}
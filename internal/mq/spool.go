@@ -0,0 +1,155 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/internal/metrics"
+	"github.com/rs/zerolog/log"
+	"go.uber.org/fx"
+)
+
+var ErrSpoolFull = errors.New("spool is full")
+
+// Spool keeps records on local disk while the queue can't be written to and
+// flushes them to the queue in order once it recovers. While records are
+// spooled new records are spooled too, so they don't overtake them.
+type Spool struct {
+	wal      *WAL
+	producer Producer
+	maxBytes int64
+
+	mu     sync.Mutex
+	oldest time.Time
+}
+
+// NewSpool returns the spool in front of producer, nil when the spool is
+// disabled or the queue is local anyway.
+func NewSpool(lc fx.Lifecycle, producer Producer) (*Spool, error) {
+	c := config.GlobalConfig.Queue.Spool
+	switch {
+	case !c.Enabled,
+		config.GlobalConfig.Delivery.Mode == DeliveryDirect,
+		config.GlobalConfig.Queue.Backend == BackendMemory,
+		config.GlobalConfig.Queue.Backend == BackendWAL:
+		return nil, nil
+	}
+	wal, err := OpenWAL(c.Path, c.SegmentBytes)
+	if err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		wal:      wal,
+		producer: producer,
+		maxBytes: c.MaxBytes,
+	}
+	s.updateMetrics()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+				s.flush(ctx)
+			}()
+			return nil
+		},
+		OnStop: func(stopCtx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+			case <-stopCtx.Done():
+			}
+			return wal.Close()
+		},
+	})
+	return s, nil
+}
+
+func (s *Spool) Enabled() bool {
+	return s != nil
+}
+
+// Pending reports whether records wait to be flushed.
+func (s *Spool) Pending() bool {
+	return s.Enabled() && s.wal.Depth() > 0
+}
+
+// Add spools msgs, it fails with ErrSpoolFull once the spool reached its
+// max size.
+func (s *Spool) Add(ctx context.Context, msgs ...Message) error {
+	if s.maxBytes > 0 && s.wal.Size() >= s.maxBytes {
+		metrics.SpoolRecords.WithLabelValues("rejected").Add(float64(len(msgs)))
+		return ErrSpoolFull
+	}
+	if err := s.wal.Produce(ctx, msgs...); err != nil {
+		return err
+	}
+	metrics.SpoolRecords.WithLabelValues("spooled").Add(float64(len(msgs)))
+	s.updateMetrics()
+	return nil
+}
+
+// flush writes the spooled records to the queue one by one, retrying each
+// until it is written.
+func (s *Spool) flush(ctx context.Context) {
+	for {
+		m, err := s.wal.Fetch(ctx)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, ErrQueueClosed) {
+				log.Error().Err(err).Msg("failed to read the spool, stop flushing")
+			}
+			return
+		}
+		s.mu.Lock()
+		s.oldest = m.Time
+		s.mu.Unlock()
+		s.updateMetrics()
+
+		backoff := time.Second
+		for {
+			writeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			err := s.producer.Produce(writeCtx, m)
+			cancel()
+			if err == nil {
+				break
+			}
+			log.Warn().Err(err).Msgf("failed to flush spooled record %s, will retry", m.Position())
+			s.updateMetrics()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+		}
+		if err := s.wal.Commit(ctx, m); err != nil {
+			log.Error().Err(err).Msgf("failed to commit flushed record %s", m.Position())
+		}
+		metrics.SpoolRecords.WithLabelValues("flushed").Inc()
+
+		s.mu.Lock()
+		s.oldest = time.Time{}
+		s.mu.Unlock()
+		s.updateMetrics()
+	}
+}
+
+func (s *Spool) updateMetrics() {
+	metrics.SpoolDepth.Set(float64(s.wal.Depth()))
+	metrics.SpoolBytes.Set(float64(s.wal.Size()))
+	s.mu.Lock()
+	oldest := s.oldest
+	s.mu.Unlock()
+	if oldest.IsZero() {
+		metrics.SpoolOldestAge.Set(0)
+		return
+	}
+	metrics.SpoolOldestAge.Set(time.Since(oldest).Seconds())
+}
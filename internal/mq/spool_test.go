@@ -0,0 +1,96 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyProducer writes to a memory queue once its failures are used up.
+type flakyProducer struct {
+	*MemoryQueue
+	mu       sync.Mutex
+	failures int
+}
+
+func (p *flakyProducer) Produce(ctx context.Context, msgs ...Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("queue is unreachable")
+	}
+	return p.MemoryQueue.Produce(ctx, msgs...)
+}
+
+func newTestSpool(t *testing.T, producer Producer, maxBytes int64) *Spool {
+	t.Helper()
+	return &Spool{wal: openTestWAL(t, t.TempDir(), 0), producer: producer, maxBytes: maxBytes}
+}
+
+func TestSpoolFlushesInOrder(t *testing.T) {
+	producer := &flakyProducer{MemoryQueue: NewMemoryQueue(10), failures: 1}
+	s := newTestSpool(t, producer, 0)
+	for i := 0; i < 3; i++ {
+		if err := s.Add(context.Background(), Message{Value: []byte(fmt.Sprintf("v%d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !s.Pending() {
+		t.Fatal("spooled records are not pending")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.flush(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for i := 0; i < 3; i++ {
+		fetchCtx, cancelFetch := context.WithTimeout(context.Background(), 5*time.Second)
+		m, err := producer.Fetch(fetchCtx)
+		cancelFetch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("v%d", i); string(m.Value) != want {
+			t.Errorf("flushed %s, want %s", m.Value, want)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.Pending() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.Pending() {
+		t.Error("flushed records are still pending")
+	}
+}
+
+func TestSpoolRejectsOnceFull(t *testing.T) {
+	s := newTestSpool(t, NewMemoryQueue(10), 256)
+	value := make([]byte, 64)
+	var err error
+	added := 0
+	for ; added < 100; added++ {
+		if err = s.Add(context.Background(), Message{Value: value}); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrSpoolFull) {
+		t.Fatalf("want ErrSpoolFull, got %v after %d records", err, added)
+	}
+	if added == 0 {
+		t.Error("the first record was rejected")
+	}
+	if d := s.wal.Depth(); d != int64(added) {
+		t.Errorf("spool holds %d records, %d were added", d, added)
+	}
+}
@@ -0,0 +1,495 @@
+package mq
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	walSegmentExt      = ".wal"
+	walCommitFile      = "committed"
+	walFrameHeaderSize = 8
+	// DefaultWALSegmentBytes is the size a segment is rolled at.
+	DefaultWALSegmentBytes = 64 << 20
+)
+
+// WAL is a durable queue on local disk. Messages are appended to segment
+// files named by the offset of their first record and synced before Produce
+// returns. The offset up to which messages were committed is kept in its own
+// file, segments below it are removed.
+//
+// A record is framed as a big endian uint32 length, the crc32 of the payload
+// and the json encoded payload. A torn record at the end of the last segment
+// is truncated on open.
+type WAL struct {
+	dir          string
+	segmentBytes int64
+
+	mu         sync.Mutex
+	segments   []int64
+	active     *os.File
+	activeSize int64
+	next       int64
+	appended   chan struct{}
+	closed     bool
+
+	// read cursor, only used by Fetch. readBase is the segment being read,
+	// it is guarded by mu as segments are removed up to it.
+	readMu     sync.Mutex
+	readOffset int64
+	readFile   *os.File
+	readPos    int64
+	readBase   int64
+	// fetched mirrors readOffset for Lag, which can't wait on readMu
+	fetched atomic.Int64
+
+	commitMu  sync.Mutex
+	committed int64
+	offsets   *offsets
+}
+
+type walRecord struct {
+	Key     []byte    `json:"key,omitempty"`
+	Value   []byte    `json:"value"`
+	Headers []Header  `json:"headers,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+func OpenWAL(dir string, segmentBytes int64) (*WAL, error) {
+	if dir == "" {
+		return nil, errors.New("wal queue path is empty")
+	}
+	if segmentBytes <= 0 {
+		segmentBytes = DefaultWALSegmentBytes
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create wal dir: %w", err)
+	}
+	w := &WAL{
+		dir:          dir,
+		segmentBytes: segmentBytes,
+		appended:     make(chan struct{}),
+		offsets:      newOffsets(),
+	}
+	if err := w.open(); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *WAL) open() error {
+	committed, err := w.readCommitted()
+	if err != nil {
+		return err
+	}
+	w.committed = committed
+	w.readOffset = committed
+	w.fetched.Store(committed)
+
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return fmt.Errorf("read wal dir: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, walSegmentExt) {
+			continue
+		}
+		base, err := strconv.ParseInt(strings.TrimSuffix(name, walSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		w.segments = append(w.segments, base)
+	}
+	slices.Sort(w.segments)
+
+	if len(w.segments) == 0 {
+		w.next = committed
+		return w.roll()
+	}
+
+	last := w.segments[len(w.segments)-1]
+	f, err := os.OpenFile(w.segmentPath(last), os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("open wal segment: %w", err)
+	}
+	count, size, err := scanSegment(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// drop a torn record left by a crash while appending
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return fmt.Errorf("truncate wal segment: %w", err)
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("seek wal segment: %w", err)
+	}
+	w.active, w.activeSize, w.next = f, size, last+count
+	if w.next < committed {
+		// everything was committed and the segments removed
+		w.next = committed
+		return w.roll()
+	}
+	return nil
+}
+
+// scanSegment counts the valid records of f and returns the size they take.
+func scanSegment(f *os.File) (int64, int64, error) {
+	var count, pos int64
+	for {
+		_, n, err := readFrame(f, pos)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errCorruptFrame) {
+				return count, pos, nil
+			}
+			return 0, 0, fmt.Errorf("scan wal segment: %w", err)
+		}
+		count++
+		pos += n
+	}
+}
+
+var errCorruptFrame = errors.New("corrupt wal frame")
+
+func readFrame(f *os.File, pos int64) (walRecord, int64, error) {
+	var rec walRecord
+	var header [walFrameHeaderSize]byte
+	if _, err := f.ReadAt(header[:], pos); err != nil {
+		return rec, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[:4])
+	sum := binary.BigEndian.Uint32(header[4:])
+	// a torn or corrupt header can claim any size, don't allocate more than
+	// the segment holds
+	fi, err := f.Stat()
+	if err != nil {
+		return rec, 0, err
+	}
+	if int64(size) > fi.Size()-pos-walFrameHeaderSize {
+		return rec, 0, fmt.Errorf("%w: %d byte record runs past the end of the segment", errCorruptFrame, size)
+	}
+	payload := make([]byte, size)
+	if _, err := f.ReadAt(payload, pos+walFrameHeaderSize); err != nil {
+		return rec, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != sum {
+		return rec, 0, errCorruptFrame
+	}
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return rec, 0, fmt.Errorf("%w: %v", errCorruptFrame, err)
+	}
+	return rec, walFrameHeaderSize + int64(size), nil
+}
+
+func (w *WAL) segmentPath(base int64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", base, walSegmentExt))
+}
+
+// roll starts a new active segment at the next offset.
+func (w *WAL) roll() error {
+	f, err := os.OpenFile(w.segmentPath(w.next), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("create wal segment: %w", err)
+	}
+	if w.active != nil {
+		w.active.Close()
+	}
+	if !slices.Contains(w.segments, w.next) {
+		w.segments = append(w.segments, w.next)
+	}
+	w.active, w.activeSize = f, 0
+	return nil
+}
+
+// Produce appends msgs and syncs them to disk.
+func (w *WAL) Produce(ctx context.Context, msgs ...Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrQueueClosed
+	}
+	for _, m := range msgs {
+		if w.activeSize >= w.segmentBytes {
+			if err := w.roll(); err != nil {
+				return err
+			}
+		}
+		t := m.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+		payload, err := json.Marshal(walRecord{Key: m.Key, Value: m.Value, Headers: m.Headers, Time: t})
+		if err != nil {
+			return err
+		}
+		frame := make([]byte, walFrameHeaderSize+len(payload))
+		binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+		copy(frame[walFrameHeaderSize:], payload)
+		if _, err := w.active.Write(frame); err != nil {
+			return fmt.Errorf("append to wal: %w", err)
+		}
+		w.activeSize += int64(len(frame))
+		w.next++
+	}
+	if err := w.active.Sync(); err != nil {
+		return fmt.Errorf("sync wal: %w", err)
+	}
+	close(w.appended)
+	w.appended = make(chan struct{})
+	return nil
+}
+
+// Fetch returns the next message, waiting for one to be produced.
+func (w *WAL) Fetch(ctx context.Context) (Message, error) {
+	w.readMu.Lock()
+	defer w.readMu.Unlock()
+	for {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return Message{}, ErrQueueClosed
+		}
+		next, appended := w.next, w.appended
+		w.mu.Unlock()
+
+		if w.readOffset < next {
+			m, err := w.read()
+			if err != nil {
+				return Message{}, err
+			}
+			w.offsets.add(m)
+			return m, nil
+		}
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		}
+	}
+}
+
+// read returns the record at the read offset and advances the cursor.
+func (w *WAL) read() (Message, error) {
+	if w.readFile == nil {
+		if err := w.seek(w.readOffset); err != nil {
+			return Message{}, err
+		}
+	}
+	rec, n, err := readFrame(w.readFile, w.readPos)
+	if errors.Is(err, io.EOF) {
+		// the segment was rolled, the record starts the next one
+		if err := w.seek(w.readOffset); err != nil {
+			return Message{}, err
+		}
+		rec, n, err = readFrame(w.readFile, w.readPos)
+	}
+	if err != nil {
+		return Message{}, fmt.Errorf("read wal offset %d: %w", w.readOffset, err)
+	}
+	m := Message{
+		Key:     rec.Key,
+		Value:   rec.Value,
+		Headers: rec.Headers,
+		Topic:   BackendWAL,
+		Offset:  w.readOffset,
+		Time:    rec.Time,
+	}
+	w.readOffset++
+	w.fetched.Store(w.readOffset)
+	w.readPos += n
+	return m, nil
+}
+
+// seek opens the segment holding offset and moves the cursor to it.
+func (w *WAL) seek(offset int64) error {
+	w.mu.Lock()
+	i, found := slices.BinarySearch(w.segments, offset)
+	if !found {
+		i--
+	}
+	if i < 0 {
+		w.mu.Unlock()
+		return fmt.Errorf("wal offset %d was removed", offset)
+	}
+	base := w.segments[i]
+	w.mu.Unlock()
+
+	f, err := os.Open(w.segmentPath(base))
+	if err != nil {
+		return fmt.Errorf("open wal segment: %w", err)
+	}
+	var pos int64
+	for o := base; o < offset; o++ {
+		_, n, err := readFrame(f, pos)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("seek wal offset %d: %w", offset, err)
+		}
+		pos += n
+	}
+	if w.readFile != nil {
+		w.readFile.Close()
+	}
+	w.readFile, w.readPos = f, pos
+	w.mu.Lock()
+	w.readBase = base
+	w.mu.Unlock()
+	return nil
+}
+
+// Commit marks m done, the committed offset moves once every message before
+// it is done too.
+func (w *WAL) Commit(ctx context.Context, m Message) error {
+	w.offsets.done(m)
+	msgs := w.offsets.take()
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	w.commitMu.Lock()
+	defer w.commitMu.Unlock()
+	committed := msgs[0].Offset + 1
+	if committed <= w.committed {
+		return nil
+	}
+	if err := w.writeCommitted(committed); err != nil {
+		return err
+	}
+	w.committed = committed
+	w.removeSegments(committed)
+	return nil
+}
+
+// removeSegments deletes the segments whose records are all committed.
+func (w *WAL) removeSegments(committed int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for len(w.segments) > 1 && w.segments[1] <= committed {
+		base := w.segments[0]
+		if base >= w.readBase {
+			// still being read, removed after the cursor moved on
+			return
+		}
+		if err := os.Remove(w.segmentPath(base)); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		w.segments = w.segments[1:]
+	}
+}
+
+func (w *WAL) readCommitted() (int64, error) {
+	b, err := os.ReadFile(filepath.Join(w.dir, walCommitFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read wal commit: %w", err)
+	}
+	committed, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parse wal commit: %w", err)
+	}
+	return committed, nil
+}
+
+func (w *WAL) writeCommitted(committed int64) error {
+	path := filepath.Join(w.dir, walCommitFile)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("write wal commit: %w", err)
+	}
+	if _, err := f.WriteString(strconv.FormatInt(committed, 10)); err != nil {
+		f.Close()
+		return fmt.Errorf("write wal commit: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync wal commit: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write wal commit: %w", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// Depth is the number of records not committed yet.
+func (w *WAL) Depth() int64 {
+	w.mu.Lock()
+	next := w.next
+	w.mu.Unlock()
+	w.commitMu.Lock()
+	defer w.commitMu.Unlock()
+	return next - w.committed
+}
+
+// Lag is the number of records not fetched yet.
+func (w *WAL) Lag(ctx context.Context) (int64, error) {
+	w.mu.Lock()
+	next := w.next
+	w.mu.Unlock()
+	return next - w.fetched.Load(), nil
+}
+
+// Size is the size of the segments on disk.
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var size int64
+	for _, base := range w.segments {
+		if base == w.segments[len(w.segments)-1] {
+			size += w.activeSize
+			continue
+		}
+		if fi, err := os.Stat(w.segmentPath(base)); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// Close stops Fetch and Produce, pending commits were already written.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.appended)
+	var err error
+	if w.active != nil {
+		err = w.active.Close()
+	}
+	w.mu.Unlock()
+
+	// a blocked Fetch returns once appended is closed
+	w.readMu.Lock()
+	if w.readFile != nil {
+		w.readFile.Close()
+		w.readFile = nil
+	}
+	w.readMu.Unlock()
+	return err
+}
@@ -0,0 +1,190 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestWAL(t *testing.T, dir string, segmentBytes int64) *WAL {
+	t.Helper()
+	w, err := OpenWAL(dir, segmentBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+func produceWAL(t *testing.T, w *WAL, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := w.Produce(context.Background(), Message{Value: []byte(fmt.Sprintf("v%d", i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func fetchWAL(t *testing.T, w *WAL, n int) []Message {
+	t.Helper()
+	msgs := make([]Message, 0, n)
+	for len(msgs) < n {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		m, err := w.Fetch(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("fetch %d of %d: %v", len(msgs)+1, n, err)
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+walSegmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestWALKeepsOrderAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	// every record rolls a segment
+	w := openTestWAL(t, dir, 1)
+	produceWAL(t, w, 0, 5)
+	if n := len(segmentFiles(t, dir)); n != 5 {
+		t.Errorf("want 5 segments, got %d", n)
+	}
+
+	msgs := fetchWAL(t, w, 5)
+	for i, m := range msgs {
+		if string(m.Value) != fmt.Sprintf("v%d", i) || m.Offset != int64(i) {
+			t.Errorf("record %d is %s at offset %d", i, m.Value, m.Offset)
+		}
+	}
+
+	// a later record done first is not committed past an earlier one
+	for _, i := range []int{2, 1} {
+		if err := w.Commit(context.Background(), msgs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := w.Depth(); d != 5 {
+		t.Errorf("depth is %d before the first record is committed, want 5", d)
+	}
+	if err := w.Commit(context.Background(), msgs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if d := w.Depth(); d != 2 {
+		t.Errorf("depth is %d, want 2", d)
+	}
+	if n := len(segmentFiles(t, dir)); n != 2 {
+		t.Errorf("want the segments of the committed records removed, %d on disk", n)
+	}
+	w.Close()
+
+	// a reopened wal continues after the committed records
+	w = openTestWAL(t, dir, 1)
+	produceWAL(t, w, 5, 6)
+	for i, m := range fetchWAL(t, w, 3) {
+		if want := fmt.Sprintf("v%d", i+3); string(m.Value) != want {
+			t.Errorf("reopened wal fetched %s, want %s", m.Value, want)
+		}
+	}
+}
+
+func TestWALRollsAtSegmentSize(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 1024)
+	produceWAL(t, w, 0, 100)
+
+	files := segmentFiles(t, dir)
+	if len(files) < 2 {
+		t.Fatalf("want the wal rolled, got %d segments", len(files))
+	}
+	var total int64
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a segment is rolled once it reached the limit, so it holds at
+		// most one record past it
+		if fi.Size() > 2*1024 {
+			t.Errorf("segment %s has %d bytes", filepath.Base(f), fi.Size())
+		}
+		total += fi.Size()
+	}
+	if size := w.Size(); size != total {
+		t.Errorf("size is %d, the segments take %d", size, total)
+	}
+	if n, _ := w.Lag(context.Background()); n != 100 {
+		t.Errorf("lag is %d, want 100", n)
+	}
+}
+
+func TestWALTruncatesTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 0)
+	produceWAL(t, w, 0, 2)
+	w.Close()
+
+	// a crash while appending left half a frame
+	f, err := os.OpenFile(segmentFiles(t, dir)[0], os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 42})
+	f.Close()
+
+	w = openTestWAL(t, dir, 0)
+	produceWAL(t, w, 2, 3)
+	for i, m := range fetchWAL(t, w, 3) {
+		if want := fmt.Sprintf("v%d", i); string(m.Value) != want {
+			t.Errorf("record %d is %s, want %s", i, m.Value, want)
+		}
+	}
+}
+
+func TestWALRejectsOversizedFrame(t *testing.T) {
+	dir := t.TempDir()
+	w := openTestWAL(t, dir, 0)
+	produceWAL(t, w, 0, 1)
+	w.Close()
+
+	// a corrupt header claims a record of almost 4GB
+	f, err := os.OpenFile(segmentFiles(t, dir)[0], os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := []byte{0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0, '{'}
+	f.Write(corrupt)
+	f.Close()
+
+	f, err = os.Open(segmentFiles(t, dir)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readFrame(f, fi.Size()-int64(len(corrupt))); !errors.Is(err, errCorruptFrame) {
+		t.Errorf("oversized frame was read: %v", err)
+	}
+
+	w = openTestWAL(t, dir, 0)
+	produceWAL(t, w, 1, 2)
+	for i, m := range fetchWAL(t, w, 2) {
+		if want := fmt.Sprintf("v%d", i); string(m.Value) != want {
+			t.Errorf("record %d is %s, want %s", i, m.Value, want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/404LifeFound/alertmanager-lark/internal/alert"
+	"github.com/go-lark/lark"
+)
+
+const memberBelongURL = "/open-apis/contact/v3/group/member_belong?%s"
+
+// User is the part of the lark contact a policy rule can match on.
+type User struct {
+	OpenID        string
+	Name          string
+	Email         string
+	DepartmentIDs []string
+}
+
+// Directory looks up lark users and the user groups they belong to.
+type Directory interface {
+	User(ctx context.Context, openID string) (*User, error)
+	Groups(ctx context.Context, openID string) ([]string, error)
+}
+
+type LarkDirectory struct {
+	Bot *lark.Bot
+}
+
+func (d *LarkDirectory) User(ctx context.Context, openID string) (*User, error) {
+	call := alert.StartLarkCall(ctx, "GetUserInfo")
+	resp, err := d.Bot.GetUserInfo(lark.WithOpenID(openID))
+	code := 0
+	if resp != nil {
+		code = resp.Code
+	}
+	call.End(code, err)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != 0 {
+		return nil, fmt.Errorf("lark api error: code=%d, msg=%s", resp.Code, resp.Msg)
+	}
+	u := resp.Data.User
+	email := u.Email
+	if email == "" {
+		email = u.EnterpriseEmail
+	}
+	return &User{
+		OpenID:        openID,
+		Name:          u.Name,
+		Email:         email,
+		DepartmentIDs: u.DepartmentIDs,
+	}, nil
+}
+
+type memberBelongResponse struct {
+	lark.BaseResponse
+	Data struct {
+		GroupList []string `json:"group_list"`
+		PageToken string   `json:"page_token"`
+		HasMore   bool     `json:"has_more"`
+	} `json:"data"`
+}
+
+func (d *LarkDirectory) Groups(ctx context.Context, openID string) ([]string, error) {
+	var groups []string
+	pageToken := ""
+	for {
+		v := url.Values{}
+		v.Set("member_id", openID)
+		v.Set("member_id_type", "open_id")
+		v.Set("page_size", "100")
+		if pageToken != "" {
+			v.Set("page_token", pageToken)
+		}
+		var resp memberBelongResponse
+		call := alert.StartLarkCall(ctx, "MemberBelong")
+		err := d.Bot.GetAPIRequest("MemberBelong", fmt.Sprintf(memberBelongURL, v.Encode()), true, nil, &resp)
+		call.End(resp.Code, err)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Code != 0 {
+			return nil, fmt.Errorf("lark api error: code=%d, msg=%s", resp.Code, resp.Msg)
+		}
+		groups = append(groups, resp.Data.GroupList...)
+		if !resp.Data.HasMore || resp.Data.PageToken == "" {
+			return groups, nil
+		}
+		pageToken = resp.Data.PageToken
+	}
+}
@@ -0,0 +1,159 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/internal/alert"
+	"github.com/go-lark/lark"
+)
+
+var actions = []string{
+	alert.ActionAcknowledge,
+	alert.ActionResolve,
+	alert.ActionSilence,
+	alert.ActionExpireSilence,
+}
+
+// Request describes a card action a lark user wants to take.
+type Request struct {
+	Action string
+	OpenID string
+	// Assignees are the emails the alert is assigned to.
+	Assignees []string
+	// Silence is the requested silence duration of a silence action.
+	Silence time.Duration
+}
+
+type Decision struct {
+	Allowed bool
+	Reason  string
+}
+
+type rule struct {
+	actions       []string
+	openIDs       []string
+	emails        []string
+	departmentIDs []string
+	userGroupIDs  []string
+	assignees     bool
+	maxSilence    time.Duration
+}
+
+func (r *rule) anyone() bool {
+	return len(r.openIDs) == 0 && len(r.emails) == 0 && len(r.departmentIDs) == 0 &&
+		len(r.userGroupIDs) == 0 && !r.assignees
+}
+
+func (r *rule) needsUser() bool {
+	return len(r.emails) > 0 || len(r.departmentIDs) > 0 || r.assignees
+}
+
+// Policy decides who may take which action from a card. An action without
+// any rule is allowed for everyone, otherwise one of its rules has to allow
+// the operator.
+type Policy struct {
+	rules     []*rule
+	directory Directory
+}
+
+func NewPolicy(bot *lark.Bot) (*Policy, error) {
+	p := &Policy{directory: &LarkDirectory{Bot: bot}}
+	for i, rc := range config.GlobalConfig.Policy.Rules {
+		for _, a := range rc.Actions {
+			if !slices.Contains(actions, a) {
+				return nil, fmt.Errorf("policy rule %d has invalid action %q, valid actions: %s", i, a, strings.Join(actions, ", "))
+			}
+		}
+		if rc.MaxSilenceMinutes < 0 {
+			return nil, fmt.Errorf("policy rule %d has negative maxSilenceMinutes", i)
+		}
+		p.rules = append(p.rules, &rule{
+			actions:       rc.Actions,
+			openIDs:       rc.OpenIDs,
+			emails:        lower(rc.Emails),
+			departmentIDs: rc.DepartmentIDs,
+			userGroupIDs:  rc.UserGroupIDs,
+			assignees:     rc.Assignees,
+			maxSilence:    time.Duration(rc.MaxSilenceMinutes) * time.Minute,
+		})
+	}
+	return p, nil
+}
+
+func (p *Policy) Authorize(ctx context.Context, req Request) Decision {
+	var applicable []*rule
+	for _, r := range p.rules {
+		if len(r.actions) == 0 || slices.Contains(r.actions, req.Action) {
+			applicable = append(applicable, r)
+		}
+	}
+	if len(applicable) == 0 {
+		return Decision{Allowed: true, Reason: "no policy for action"}
+	}
+
+	var user *User
+	var groups []string
+	var lookupErr error
+	userLoaded, groupsLoaded := false, false
+	for i, r := range applicable {
+		if req.Action == alert.ActionSilence && r.maxSilence > 0 && req.Silence > r.maxSilence {
+			continue
+		}
+		if r.anyone() || slices.Contains(r.openIDs, req.OpenID) {
+			return Decision{Allowed: true, Reason: fmt.Sprintf("allowed by rule %d", i)}
+		}
+		if r.needsUser() && !userLoaded {
+			userLoaded = true
+			if user, lookupErr = p.directory.User(ctx, req.OpenID); lookupErr != nil {
+				user = nil
+			}
+		}
+		if user != nil {
+			email := strings.ToLower(user.Email)
+			if email != "" && slices.Contains(r.emails, email) {
+				return Decision{Allowed: true, Reason: fmt.Sprintf("allowed by rule %d", i)}
+			}
+			if r.assignees && email != "" && slices.Contains(lower(req.Assignees), email) {
+				return Decision{Allowed: true, Reason: fmt.Sprintf("allowed as assignee by rule %d", i)}
+			}
+			for _, d := range user.DepartmentIDs {
+				if slices.Contains(r.departmentIDs, d) {
+					return Decision{Allowed: true, Reason: fmt.Sprintf("allowed by department of rule %d", i)}
+				}
+			}
+		}
+		if len(r.userGroupIDs) > 0 && !groupsLoaded {
+			groupsLoaded = true
+			if groups, lookupErr = p.directory.Groups(ctx, req.OpenID); lookupErr != nil {
+				groups = nil
+			}
+		}
+		for _, g := range groups {
+			if slices.Contains(r.userGroupIDs, g) {
+				return Decision{Allowed: true, Reason: fmt.Sprintf("allowed by user group of rule %d", i)}
+			}
+		}
+	}
+
+	reason := "no policy rule allows the operator"
+	if req.Action == alert.ActionSilence && req.Silence > 0 {
+		reason = fmt.Sprintf("no policy rule allows the operator to silence for %s", req.Silence)
+	}
+	if lookupErr != nil {
+		reason = fmt.Sprintf("%s, lookup failed: %v", reason, lookupErr)
+	}
+	return Decision{Allowed: false, Reason: reason}
+}
+
+func lower(values []string) []string {
+	out := make([]string, 0, len(values))
+	for _, v := range values {
+		out = append(out, strings.ToLower(strings.TrimSpace(v)))
+	}
+	return out
+}
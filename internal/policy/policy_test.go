@@ -0,0 +1,121 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/config/configtest"
+	"github.com/404LifeFound/alertmanager-lark/internal/alert"
+)
+
+// directory is a fixed lark contact, lookups of unknown users fail.
+type directory struct {
+	users   map[string]*User
+	groups  map[string][]string
+	lookups int
+}
+
+func (d *directory) User(ctx context.Context, openID string) (*User, error) {
+	d.lookups++
+	if u, ok := d.users[openID]; ok {
+		return u, nil
+	}
+	return nil, errors.New("user not found")
+}
+
+func (d *directory) Groups(ctx context.Context, openID string) ([]string, error) {
+	d.lookups++
+	return d.groups[openID], nil
+}
+
+// newTestPolicy builds the policy of rules looking users up in d.
+func newTestPolicy(t *testing.T, d Directory, rules ...config.PolicyRuleConfig) *Policy {
+	t.Helper()
+	configtest.Set(t).Policy.Rules = rules
+	p, err := NewPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.directory = d
+	return p
+}
+
+func testDirectory() *directory {
+	return &directory{
+		users: map[string]*User{
+			"ou_ops":   {OpenID: "ou_ops", Email: "Ops@Example.com", DepartmentIDs: []string{"od_sre"}},
+			"ou_dev":   {OpenID: "ou_dev", Email: "dev@example.com", DepartmentIDs: []string{"od_web"}},
+			"ou_guest": {OpenID: "ou_guest"},
+		},
+		groups: map[string][]string{"ou_guest": {"g_oncall"}},
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	p := newTestPolicy(t, testDirectory(),
+		config.PolicyRuleConfig{Actions: []string{alert.ActionResolve}, OpenIDs: []string{"ou_lead"}},
+		config.PolicyRuleConfig{Actions: []string{alert.ActionResolve}, Emails: []string{" ops@example.com"}},
+		config.PolicyRuleConfig{Actions: []string{alert.ActionAcknowledge}, Assignees: true},
+		config.PolicyRuleConfig{Actions: []string{alert.ActionAcknowledge}, DepartmentIDs: []string{"od_sre"}},
+		config.PolicyRuleConfig{Actions: []string{alert.ActionExpireSilence}, UserGroupIDs: []string{"g_oncall"}},
+	)
+
+	tests := []struct {
+		name string
+		req  Request
+		want bool
+	}{
+		{"action without rules", Request{Action: alert.ActionSilence, OpenID: "ou_unknown"}, true},
+		{"listed open id", Request{Action: alert.ActionResolve, OpenID: "ou_lead"}, true},
+		{"listed email", Request{Action: alert.ActionResolve, OpenID: "ou_ops"}, true},
+		{"unlisted user", Request{Action: alert.ActionResolve, OpenID: "ou_dev"}, false},
+		{"unknown user", Request{Action: alert.ActionResolve, OpenID: "ou_unknown"}, false},
+		{"assignee", Request{Action: alert.ActionAcknowledge, OpenID: "ou_dev", Assignees: []string{"DEV@example.com"}}, true},
+		{"not the assignee", Request{Action: alert.ActionAcknowledge, OpenID: "ou_dev", Assignees: []string{"ops@example.com"}}, false},
+		{"department", Request{Action: alert.ActionAcknowledge, OpenID: "ou_ops"}, true},
+		{"user group", Request{Action: alert.ActionExpireSilence, OpenID: "ou_guest"}, true},
+		{"outside the user group", Request{Action: alert.ActionExpireSilence, OpenID: "ou_ops"}, false},
+	}
+	for _, tt := range tests {
+		if got := p.Authorize(context.Background(), tt.req); got.Allowed != tt.want {
+			t.Errorf("%s: allowed is %t, want %t (%s)", tt.name, got.Allowed, tt.want, got.Reason)
+		}
+	}
+}
+
+func TestAuthorizeMaxSilence(t *testing.T) {
+	d := testDirectory()
+	p := newTestPolicy(t, d,
+		config.PolicyRuleConfig{Actions: []string{alert.ActionSilence}, MaxSilenceMinutes: 60},
+		config.PolicyRuleConfig{Actions: []string{alert.ActionSilence}, OpenIDs: []string{"ou_lead"}},
+	)
+
+	if got := p.Authorize(context.Background(), Request{Action: alert.ActionSilence, OpenID: "ou_dev", Silence: time.Hour}); !got.Allowed {
+		t.Errorf("silence within the limit was denied: %s", got.Reason)
+	}
+	if got := p.Authorize(context.Background(), Request{Action: alert.ActionSilence, OpenID: "ou_dev", Silence: 2 * time.Hour}); got.Allowed {
+		t.Error("silence over the limit was allowed")
+	}
+	if got := p.Authorize(context.Background(), Request{Action: alert.ActionSilence, OpenID: "ou_lead", Silence: 24 * time.Hour}); !got.Allowed {
+		t.Errorf("unlimited silence of a listed user was denied: %s", got.Reason)
+	}
+	if d.lookups != 0 {
+		t.Errorf("open id rules looked the user up %d times", d.lookups)
+	}
+}
+
+func TestNewPolicyRejectsInvalidRules(t *testing.T) {
+	cfg := configtest.Set(t)
+	for _, rc := range []config.PolicyRuleConfig{
+		{Actions: []string{"delete"}},
+		{Actions: []string{alert.ActionSilence}, MaxSilenceMinutes: -1},
+	} {
+		cfg.Policy.Rules = []config.PolicyRuleConfig{rc}
+		if _, err := NewPolicy(nil); err == nil {
+			t.Errorf("invalid rule %+v was accepted", rc)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package route
+
+import (
+	"fmt"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/internal/alert"
+)
+
+// Receiver maps an alertmanager receiver, addressed by the webhook url path
+// or webhook.Message.Receiver, to its own chats, mention policy, card
+// template and card mode.
+type Receiver struct {
+	Name     string
+	ChatIDs  []string
+	Mention  string
+	Template string
+	Mode     string
+}
+
+type Receivers map[string]*Receiver
+
+func NewReceivers(templates *alert.Templates) (Receivers, error) {
+	receivers := Receivers{}
+	for _, rc := range config.GlobalConfig.Receivers {
+		if rc.Name == "" {
+			return nil, fmt.Errorf("receiver name must not be empty")
+		}
+		if _, ok := receivers[rc.Name]; ok {
+			return nil, fmt.Errorf("duplicate receiver %q", rc.Name)
+		}
+		switch rc.Mention {
+		case alert.MentionDefault, alert.MentionAll, alert.MentionAssignees, alert.MentionNone:
+		default:
+			return nil, fmt.Errorf("receiver %q has invalid mention policy %q", rc.Name, rc.Mention)
+		}
+		switch rc.Mode {
+		case "", alert.ModeAlert, alert.ModeGrouped:
+		default:
+			return nil, fmt.Errorf("receiver %q has invalid card mode %q", rc.Name, rc.Mode)
+		}
+		if rc.Template != "" && !templates.Has(rc.Template) {
+			return nil, fmt.Errorf("receiver %q uses undefined card template %q", rc.Name, rc.Template)
+		}
+		receivers[rc.Name] = &Receiver{
+			Name:     rc.Name,
+			ChatIDs:  rc.ChatIDs,
+			Mention:  rc.Mention,
+			Template: rc.Template,
+			Mode:     rc.Mode,
+		}
+	}
+	return receivers, nil
+}
+
+// Lookup returns the first configured receiver among names.
+func (rs Receivers) Lookup(names ...string) (*Receiver, bool) {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if r, ok := rs[name]; ok {
+			return r, true
+		}
+	}
+	return nil, false
+}
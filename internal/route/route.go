@@ -0,0 +1,100 @@
+package route
+
+import (
+	"fmt"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/prometheus/alertmanager/pkg/labels"
+	"github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/common/model"
+)
+
+// Route is a node of the routing tree, it follows the semantics of the
+// alertmanager route: the first matching child wins unless it sets
+// Continue, and a node without matching children matches itself.
+type Route struct {
+	Matchers labels.Matchers
+	ChatIDs  []string
+	Continue bool
+	Routes   []*Route
+}
+
+// NewTree builds the routing tree from config, the root route is the
+// default route and falls back to lark.chatID.
+func NewTree() (*Route, error) {
+	root := config.GlobalConfig.Route
+	if len(root.ChatIDs) == 0 && config.GlobalConfig.Lark.ChatID != "" {
+		root.ChatIDs = []string{config.GlobalConfig.Lark.ChatID}
+	}
+	if len(root.Matchers) > 0 {
+		return nil, fmt.Errorf("root route must not have matchers")
+	}
+	return NewRoute(root, nil)
+}
+
+func NewRoute(cfg config.RouteConfig, parent *Route) (*Route, error) {
+	r := &Route{
+		ChatIDs:  cfg.ChatIDs,
+		Continue: cfg.Continue,
+	}
+	if len(r.ChatIDs) == 0 && parent != nil {
+		r.ChatIDs = parent.ChatIDs
+	}
+	for _, s := range cfg.Matchers {
+		ms, err := labels.ParseMatchers(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route matcher %q: %w", s, err)
+		}
+		r.Matchers = append(r.Matchers, ms...)
+	}
+	for _, child := range cfg.Routes {
+		cr, err := NewRoute(child, r)
+		if err != nil {
+			return nil, err
+		}
+		r.Routes = append(r.Routes, cr)
+	}
+	return r, nil
+}
+
+func (r *Route) Match(lset model.LabelSet) []*Route {
+	if !r.Matchers.Matches(lset) {
+		return nil
+	}
+
+	var all []*Route
+	for _, cr := range r.Routes {
+		matches := cr.Match(lset)
+		all = append(all, matches...)
+		if matches != nil && !cr.Continue {
+			break
+		}
+	}
+
+	// If no child nodes were matches, the current node itself is a match.
+	if len(all) == 0 {
+		all = append(all, r)
+	}
+	return all
+}
+
+// MatchChatIDs returns the deduplicated chats an alert with kv labels is delivered to.
+func (r *Route) MatchChatIDs(kv template.KV) []string {
+	lset := make(model.LabelSet, len(kv))
+	for k, v := range kv {
+		lset[model.LabelName(k)] = model.LabelValue(v)
+	}
+
+	var chatIDs []string
+	seen := map[string]bool{}
+	for _, m := range r.Match(lset) {
+		for _, id := range m.ChatIDs {
+			if id == "" || seen[id] {
+				continue
+			}
+			seen[id] = true
+			chatIDs = append(chatIDs, id)
+		}
+	}
+	return chatIDs
+}
@@ -0,0 +1,86 @@
+package route
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/config/configtest"
+	"github.com/prometheus/alertmanager/template"
+)
+
+func newTestTree(t *testing.T, root config.RouteConfig) *Route {
+	t.Helper()
+	cfg := configtest.Set(t)
+	cfg.Lark.ChatID = "oc_default"
+	cfg.Route = root
+	tree, err := NewTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestMatchChatIDs(t *testing.T) {
+	tree := newTestTree(t, config.RouteConfig{
+		Routes: []config.RouteConfig{
+			{Matchers: []string{`team="db"`, `severity!="info"`}, ChatIDs: []string{"oc_db"}, Continue: true},
+			{Matchers: []string{`alertname=~"Disk.*"`}, ChatIDs: []string{"oc_disk", "oc_db"}},
+			{Matchers: []string{`env!~"dev|test"`}, Routes: []config.RouteConfig{
+				{Matchers: []string{`team="web"`}, ChatIDs: []string{"oc_web"}},
+			}},
+		},
+	})
+
+	tests := []struct {
+		name   string
+		labels template.KV
+		want   []string
+	}{
+		{"equal and not equal", template.KV{"team": "db", "severity": "critical", "env": "dev"}, []string{"oc_db"}},
+		{"not equal excludes", template.KV{"team": "db", "severity": "info", "env": "dev"}, []string{"oc_default"}},
+		{"continue to the next route, chats deduplicated", template.KV{"team": "db", "alertname": "DiskFull"}, []string{"oc_db", "oc_disk"}},
+		{"regex stops at the first match", template.KV{"alertname": "DiskFull", "team": "web"}, []string{"oc_disk", "oc_db"}},
+		{"negative regex to a nested route", template.KV{"team": "web", "env": "prod"}, []string{"oc_web"}},
+		{"route without chats inherits them", template.KV{"team": "api", "env": "prod"}, []string{"oc_default"}},
+		{"negative regex excludes", template.KV{"team": "web", "env": "test"}, []string{"oc_default"}},
+		{"no matching route", template.KV{"env": "dev"}, []string{"oc_default"}},
+	}
+	for _, tt := range tests {
+		if got := tree.MatchChatIDs(tt.labels); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRootRouteChats(t *testing.T) {
+	tree := newTestTree(t, config.RouteConfig{ChatIDs: []string{"oc_root"}})
+	if got := tree.MatchChatIDs(template.KV{"team": "db"}); !reflect.DeepEqual(got, []string{"oc_root"}) {
+		t.Errorf("root route chats replace lark.chatID, got %v", got)
+	}
+
+	cfg := configtest.Set(t)
+	cfg.Lark.ChatID = ""
+	cfg.Route = config.RouteConfig{}
+	tree, err := NewTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tree.MatchChatIDs(template.KV{"team": "db"}); len(got) != 0 {
+		t.Errorf("want no chats without a default route, got %v", got)
+	}
+}
+
+func TestNewTreeRejectsInvalidRoutes(t *testing.T) {
+	cfg := configtest.Set(t)
+	for _, root := range []config.RouteConfig{
+		{Matchers: []string{`team="db"`}},
+		{Routes: []config.RouteConfig{{Matchers: []string{`team~"db"`}}}},
+		{Routes: []config.RouteConfig{{Routes: []config.RouteConfig{{Matchers: []string{`team=~"[db"`}}}}}},
+	} {
+		cfg.Route = root
+		if _, err := NewTree(); err == nil {
+			t.Errorf("invalid route %+v was accepted", root)
+		}
+	}
+}
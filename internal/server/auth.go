@@ -0,0 +1,294 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/internal/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultSignatureHeader = "X-Webhook-Signature"
+	defaultTimestampHeader = "X-Webhook-Timestamp"
+)
+
+// webhookAuth holds the credentials webhooks of a route are accepted with.
+// Secrets are kept as sha256 sums so they are compared in constant time.
+type webhookAuth struct {
+	bearer          [][]byte
+	basic           [][2][]byte
+	hmacSecrets     [][]byte
+	signatureHeader string
+	timestampHeader string
+	maxSkew         time.Duration
+	clientCert      bool
+	allowedNames    []string
+}
+
+func newWebhookAuth(name string, ac *config.WebhookAuthConfig) (*webhookAuth, error) {
+	a := &webhookAuth{
+		signatureHeader: ac.HMAC.SignatureHeader,
+		timestampHeader: ac.HMAC.TimestampHeader,
+		maxSkew:         time.Duration(ac.HMAC.MaxSkewSeconds) * time.Second,
+		clientCert:      ac.ClientCert.Required,
+		allowedNames:    ac.ClientCert.AllowedNames,
+	}
+	if a.signatureHeader == "" {
+		a.signatureHeader = defaultSignatureHeader
+	}
+	if a.timestampHeader == "" {
+		a.timestampHeader = defaultTimestampHeader
+	}
+	if a.maxSkew <= 0 {
+		a.maxSkew = 5 * time.Minute
+	}
+	for _, token := range ac.BearerTokens {
+		if token == "" {
+			return nil, fmt.Errorf("%s has an empty bearer token", name)
+		}
+		a.bearer = append(a.bearer, sum(token))
+	}
+	for _, b := range ac.BasicAuth {
+		if b.Username == "" || b.Password == "" {
+			return nil, fmt.Errorf("%s has basic auth without username or password", name)
+		}
+		a.basic = append(a.basic, [2][]byte{sum(b.Username), sum(b.Password)})
+	}
+	for _, secret := range ac.HMAC.Secrets {
+		if secret == "" {
+			return nil, fmt.Errorf("%s has an empty hmac secret", name)
+		}
+		a.hmacSecrets = append(a.hmacSecrets, []byte(secret))
+	}
+	if a.clientCert && config.GlobalConfig.Http.TLS.ClientCAFile == "" {
+		return nil, fmt.Errorf("%s requires client certificates, but http.tls.clientCAFile is not set", name)
+	}
+	return a, nil
+}
+
+func sum(s string) []byte {
+	h := sha256.Sum256([]byte(s))
+	return h[:]
+}
+
+// credentials reports whether any bearer token, basic auth or hmac secret
+// is configured.
+func (a *webhookAuth) credentials() bool {
+	return len(a.bearer) > 0 || len(a.basic) > 0 || len(a.hmacSecrets) > 0
+}
+
+func (a *webhookAuth) enabled() bool {
+	return a.credentials() || a.clientCert
+}
+
+// authenticate returns the reason and error the request is rejected with.
+func (a *webhookAuth) authenticate(c *gin.Context) (string, error) {
+	if a.clientCert {
+		if reason, err := a.verifyClientCert(c.Request.TLS); err != nil {
+			return reason, err
+		}
+		if !a.credentials() {
+			return "", nil
+		}
+	}
+
+	if len(a.bearer) > 0 {
+		if token, ok := bearerToken(c.GetHeader("Authorization")); ok {
+			if !matchAny(a.bearer, sum(token)) {
+				return "invalid_bearer_token", fmt.Errorf("invalid bearer token")
+			}
+			return "", nil
+		}
+	}
+	if len(a.basic) > 0 {
+		if username, password, ok := c.Request.BasicAuth(); ok {
+			u, p := sum(username), sum(password)
+			for _, b := range a.basic {
+				if subtle.ConstantTimeCompare(b[0], u)&subtle.ConstantTimeCompare(b[1], p) == 1 {
+					return "", nil
+				}
+			}
+			return "invalid_basic_auth", fmt.Errorf("invalid username or password")
+		}
+	}
+	if len(a.hmacSecrets) > 0 {
+		if signature := c.GetHeader(a.signatureHeader); signature != "" {
+			return a.verifySignature(c, signature)
+		}
+	}
+	return "missing_credentials", fmt.Errorf("no accepted credentials in request")
+}
+
+func bearerToken(header string) (string, bool) {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func matchAny(sums [][]byte, s []byte) bool {
+	matched := 0
+	for _, candidate := range sums {
+		matched |= subtle.ConstantTimeCompare(candidate, s)
+	}
+	return matched == 1
+}
+
+// verifySignature checks the hmac of the timestamp and body against every
+// secret.
+func (a *webhookAuth) verifySignature(c *gin.Context, signature string) (string, error) {
+	timestamp := c.GetHeader(a.timestampHeader)
+	if timestamp == "" {
+		return "missing_timestamp", fmt.Errorf("missing %s header", a.timestampHeader)
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "invalid_timestamp", fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > a.maxSkew || skew < -a.maxSkew {
+		return "stale_timestamp", fmt.Errorf("timestamp %s is outside of the %s window", timestamp, a.maxSkew)
+	}
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return "invalid_signature", fmt.Errorf("signature is not hex encoded")
+	}
+
+	body, err := requestBody(c)
+	if err != nil {
+		return "read_body", err
+	}
+
+	for _, secret := range a.hmacSecrets {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(timestamp))
+		mac.Write([]byte("."))
+		mac.Write(body)
+		if hmac.Equal(mac.Sum(nil), expected) {
+			return "", nil
+		}
+	}
+	return "invalid_signature", fmt.Errorf("signature mismatch")
+}
+
+// requestBody reads the body of c once, it is kept for the handler to bind.
+func requestBody(c *gin.Context) ([]byte, error) {
+	if b, ok := c.Get(gin.BodyBytesKey); ok {
+		if body, ok := b.([]byte); ok {
+			return body, nil
+		}
+	}
+	body, err := c.GetRawData()
+	if err != nil {
+		return nil, err
+	}
+	c.Set(gin.BodyBytesKey, body)
+	return body, nil
+}
+
+// webhookRoute returns the route a webhook is delivered to like the handler
+// resolves it: the route of the url path, or else the receiver named in the
+// body, so a webhook can't reach a route without passing its auth.
+func webhookRoute(c *gin.Context) string {
+	if name := c.Param("route"); name != "" {
+		return name
+	}
+	body, err := requestBody(c)
+	if err != nil {
+		return ""
+	}
+	var event struct {
+		Receiver string `json:"receiver"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		// the handler rejects the body as well
+		return ""
+	}
+	return event.Receiver
+}
+
+func (a *webhookAuth) verifyClientCert(state *tls.ConnectionState) (string, error) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "missing_client_cert", fmt.Errorf("no verified client certificate")
+	}
+	if len(a.allowedNames) == 0 {
+		return "", nil
+	}
+	cert := state.VerifiedChains[0][0]
+	if slices.Contains(a.allowedNames, cert.Subject.CommonName) {
+		return "", nil
+	}
+	for _, name := range cert.DNSNames {
+		if slices.Contains(a.allowedNames, name) {
+			return "", nil
+		}
+	}
+	return "client_cert_not_allowed", fmt.Errorf("client certificate %s is not allowed", cert.Subject.CommonName)
+}
+
+// webhookAuthMiddleware rejects webhooks without valid credentials. A route
+// with its own auth replaces webhook.auth for webhooks to its url path and
+// webhooks to the default endpoint naming it as receiver, the other routes
+// use webhook.auth.
+func webhookAuthMiddleware() (gin.HandlerFunc, error) {
+	global, err := newWebhookAuth("webhook.auth", &config.GlobalConfig.Webhook.Auth)
+	if err != nil {
+		return nil, err
+	}
+	routes := map[string]*webhookAuth{}
+	for _, rc := range config.GlobalConfig.Receivers {
+		if rc.Auth == nil {
+			continue
+		}
+		if routes[rc.Name], err = newWebhookAuth(fmt.Sprintf("receiver %q auth", rc.Name), rc.Auth); err != nil {
+			return nil, err
+		}
+	}
+	if !global.enabled() {
+		log.Warn().Msg("webhook auth is not configured, webhooks without a route of their own auth are accepted from anyone")
+	}
+
+	reject := func(c *gin.Context, reason string, err error) {
+		metrics.WebhookRejected.WithLabelValues(reason).Inc()
+		log.Warn().Err(err).Str("reason", reason).Str("client_ip", c.ClientIP()).Msg("rejected webhook")
+		if reason == "missing_credentials" {
+			c.Header("WWW-Authenticate", `Bearer realm="alertmanager-lark"`)
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"message": "webhook authentication failed",
+			"error":   err.Error(),
+		})
+	}
+
+	return func(c *gin.Context) {
+		auth := global
+		if len(routes) > 0 {
+			if a, ok := routes[webhookRoute(c)]; ok {
+				auth = a
+			}
+		}
+		if !auth.enabled() {
+			c.Next()
+			return
+		}
+		if reason, err := auth.authenticate(c); err != nil {
+			reject(c, reason, err)
+			return
+		}
+		c.Next()
+	}, nil
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/config/configtest"
+	"github.com/gin-gonic/gin"
+)
+
+// webhookEngine accepts webhooks behind the auth middleware, the handler
+// binds the body as the webhook handler does.
+func webhookEngine(t *testing.T) *gin.Engine {
+	t.Helper()
+	auth, err := webhookAuthMiddleware()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := gin.New()
+	handler := func(c *gin.Context) {
+		var body map[string]any
+		if err := c.ShouldBindBodyWithJSON(&body); err != nil {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+	e.POST("/webhook", auth, handler)
+	e.POST("/webhook/:route", auth, handler)
+	return e
+}
+
+func postWebhook(e *gin.Engine, path string, body string, set func(r *http.Request)) int {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if set != nil {
+		set(r)
+	}
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	return w.Code
+}
+
+const webhookBody = `{"receiver": "default", "status": "firing"}`
+
+func sign(secret string, timestamp time.Time, body string) (string, string) {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "." + body))
+	return ts, "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookBearerAndBasicAuth(t *testing.T) {
+	cfg := configtest.Set(t)
+	cfg.Webhook.Auth = config.WebhookAuthConfig{
+		BearerTokens: []string{"old", "new"},
+		BasicAuth:    []config.BasicAuthConfig{{Username: "am", Password: "secret"}},
+	}
+	e := webhookEngine(t)
+
+	tests := []struct {
+		name string
+		set  func(r *http.Request)
+		want int
+	}{
+		{"no credentials", nil, http.StatusUnauthorized},
+		{"bearer token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer new") }, http.StatusOK},
+		{"rotated bearer token", func(r *http.Request) { r.Header.Set("Authorization", "bearer old") }, http.StatusOK},
+		{"wrong bearer token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer other") }, http.StatusUnauthorized},
+		{"basic auth", func(r *http.Request) { r.SetBasicAuth("am", "secret") }, http.StatusOK},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("am", "other") }, http.StatusUnauthorized},
+		{"password of another user", func(r *http.Request) { r.SetBasicAuth("other", "secret") }, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if got := postWebhook(e, "/webhook", webhookBody, tt.set); got != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookHMACAuth(t *testing.T) {
+	cfg := configtest.Set(t)
+	cfg.Webhook.Auth.HMAC = config.WebhookHMACConfig{Secrets: []string{"s1", "s2"}, MaxSkewSeconds: 60}
+	e := webhookEngine(t)
+	now := time.Now()
+
+	signed := func(secret string, timestamp time.Time, body string) func(r *http.Request) {
+		return func(r *http.Request) {
+			ts, signature := sign(secret, timestamp, body)
+			r.Header.Set(defaultTimestampHeader, ts)
+			r.Header.Set(defaultSignatureHeader, signature)
+		}
+	}
+	tests := []struct {
+		name string
+		set  func(r *http.Request)
+		want int
+	}{
+		{"signed", signed("s1", now, webhookBody), http.StatusOK},
+		{"signed with the second secret", signed("s2", now, webhookBody), http.StatusOK},
+		{"wrong secret", signed("s3", now, webhookBody), http.StatusUnauthorized},
+		{"tampered body", signed("s1", now, `{"receiver": "other"}`), http.StatusUnauthorized},
+		{"stale", signed("s1", now.Add(-2*time.Minute), webhookBody), http.StatusUnauthorized},
+		{"from the future", signed("s1", now.Add(2*time.Minute), webhookBody), http.StatusUnauthorized},
+		{"without timestamp", func(r *http.Request) {
+			_, signature := sign("s1", now, webhookBody)
+			r.Header.Set(defaultSignatureHeader, signature)
+		}, http.StatusUnauthorized},
+		{"timestamp of another signature", func(r *http.Request) {
+			signed("s1", now, webhookBody)(r)
+			r.Header.Set(defaultTimestampHeader, strconv.FormatInt(now.Unix()-1, 10))
+		}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if got := postWebhook(e, "/webhook", webhookBody, tt.set); got != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookRouteAuth(t *testing.T) {
+	cfg := configtest.Set(t)
+	cfg.Webhook.Auth.BearerTokens = []string{"global"}
+	cfg.Receivers = []config.ReceiverConfig{
+		{Name: "team", Auth: &config.WebhookAuthConfig{BearerTokens: []string{"team"}}},
+		{Name: "open", Auth: &config.WebhookAuthConfig{}},
+		{Name: "db"},
+	}
+	e := webhookEngine(t)
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	tests := []struct {
+		path  string
+		token string
+		want  int
+	}{
+		{"/webhook", "global", http.StatusOK},
+		{"/webhook/team", "team", http.StatusOK},
+		{"/webhook/team", "global", http.StatusUnauthorized},
+		{"/webhook/db", "global", http.StatusOK},
+		{"/webhook/db", "team", http.StatusUnauthorized},
+		{"/webhook/open", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := postWebhook(e, tt.path, webhookBody, bearer(tt.token)); got != tt.want {
+			t.Errorf("%s with token %q: got status %d, want %d", tt.path, tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookBodyReceiverAuth(t *testing.T) {
+	cfg := configtest.Set(t)
+	cfg.Webhook.Auth.HMAC.Secrets = []string{"global"}
+	cfg.Receivers = []config.ReceiverConfig{
+		{Name: "team-db", Auth: &config.WebhookAuthConfig{BearerTokens: []string{"team"}}},
+	}
+	e := webhookEngine(t)
+	protected := `{"receiver": "team-db", "status": "firing"}`
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	signed := func(body string) func(r *http.Request) {
+		return func(r *http.Request) {
+			ts, signature := sign("global", time.Now(), body)
+			r.Header.Set(defaultTimestampHeader, ts)
+			r.Header.Set(defaultSignatureHeader, signature)
+		}
+	}
+
+	tests := []struct {
+		name string
+		body string
+		set  func(r *http.Request)
+		want int
+	}{
+		{"protected receiver without credentials", protected, nil, http.StatusUnauthorized},
+		{"protected receiver with the global credentials", protected, signed(protected), http.StatusUnauthorized},
+		{"protected receiver with its own credentials", protected, bearer("team"), http.StatusOK},
+		{"other receiver with the global credentials", webhookBody, signed(webhookBody), http.StatusOK},
+		{"other receiver with the credentials of the protected receiver", webhookBody, bearer("team"), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		if got := postWebhook(e, "/webhook", tt.body, tt.set); got != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWebhookAuthRejectsEmptyCredentials(t *testing.T) {
+	for _, ac := range []config.WebhookAuthConfig{
+		{BearerTokens: []string{""}},
+		{BasicAuth: []config.BasicAuthConfig{{Username: "am"}}},
+		{HMAC: config.WebhookHMACConfig{Secrets: []string{""}}},
+	} {
+		cfg := configtest.Set(t)
+		cfg.Webhook.Auth = ac
+		if _, err := webhookAuthMiddleware(); err == nil {
+			t.Errorf("auth %+v was accepted", ac)
+		}
+	}
+}
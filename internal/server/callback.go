@@ -0,0 +1,362 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/internal/alert"
+	"github.com/404LifeFound/alertmanager-lark/internal/alertmanager"
+	"github.com/404LifeFound/alertmanager-lark/internal/metrics"
+	"github.com/404LifeFound/alertmanager-lark/internal/policy"
+	"github.com/404LifeFound/alertmanager-lark/internal/state"
+	"github.com/404LifeFound/alertmanager-lark/internal/tracing"
+	larkgin "github.com/404LifeFound/lark-gin/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-lark/lark"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// pickerLayouts are the formats lark sends the value of a datetime picker in.
+var pickerLayouts = []string{
+	"2006-01-02 15:04 -0700",
+	"2006-01-02 15:04 Z0700",
+	"2006-01-02 -0700",
+}
+
+type CallbackHandler struct {
+	Bot          *lark.Bot
+	Alertmanager *alertmanager.Client
+	Store        state.Store
+	Policy       *policy.Policy
+	Middleware   *larkgin.LarkMiddleware
+
+	// actions are the card actions still running after their callback was
+	// answered
+	actions sync.WaitGroup
+}
+
+func (h *CallbackHandler) Callback(c *gin.Context) {
+	ctx, span := tracing.Tracer.Start(c.Request.Context(), "card callback", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	if card, ok := h.Middleware.GetCardCallback(c); ok {
+		log.Info().Msgf("received lark card callback: %+v", card)
+		var action_value alert.CardActionValue
+
+		err := json.Unmarshal(card.Event.Action.Value, &action_value)
+		if err != nil {
+			log.Error().Msgf("can't unmarshal card action value to CardActionValue: %v", err)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"message": "invalid action request",
+				"error":   err.Error(),
+			})
+			return
+		}
+		span.SetAttributes(
+			attribute.String("action", action_value.Action),
+			attribute.String("fingerprint", action_value.Fingerprint),
+			attribute.String("group_key", action_value.GroupKey),
+		)
+		l, err := h.card(card, &action_value)
+		if err != nil {
+			log.Error().Err(err).Msgf("no card state of alert %s", action_value.Fingerprint)
+			metrics.CallbackActions.WithLabelValues(action_value.Action, "unknown").Inc()
+			c.JSON(http.StatusOK, toast("error", "This alert is no longer tracked, wait for its next notification"))
+			return
+		}
+		now := time.Now()
+		var endsAt time.Time
+		if action_value.Action == alert.ActionSilence {
+			if endsAt, err = silenceEnd(&action_value, cardActionOption(c), now); err != nil {
+				log.Error().Err(err).Msgf("invalid silence request for alert %s", action_value.Fingerprint)
+				metrics.CallbackActions.WithLabelValues(action_value.Action, "invalid").Inc()
+				c.JSON(http.StatusOK, toast("error", err.Error()))
+				return
+			}
+		}
+
+		decision := h.Policy.Authorize(ctx, policy.Request{
+			Action:    action_value.Action,
+			OpenID:    card.Event.Operator.OpenID,
+			Assignees: l.AssignEmails,
+			Silence:   endsAt.Sub(now),
+		})
+		audit := log.Info()
+		if !decision.Allowed {
+			audit = log.Warn()
+		}
+		audit.Str("audit", "card_action").
+			Str("operator", card.Event.Operator.OpenID).
+			Str("action", action_value.Action).
+			Str("fingerprint", action_value.Fingerprint).
+			Str("group_key", action_value.GroupKey).
+			Str("chat_id", card.Event.Context.OpenChatID).
+			Bool("allowed", decision.Allowed).
+			Str("reason", decision.Reason).
+			Msg("card action authorization")
+		span.SetAttributes(attribute.Bool("allowed", decision.Allowed))
+		if !decision.Allowed {
+			metrics.CallbackActions.WithLabelValues(action_value.Action, "denied").Inc()
+			c.JSON(http.StatusOK, toast("error", fmt.Sprintf("You are not allowed to %s this alert: %s", actionName(action_value.Action), decision.Reason)))
+			return
+		}
+
+		// the action outlives the request, its span only keeps the trace
+		action_ctx, action_span := tracing.Tracer.Start(trace.ContextWithSpanContext(context.Background(), span.SpanContext()),
+			"card action "+action_value.Action)
+		h.actions.Add(1)
+		go func() {
+			defer h.actions.Done()
+			var err error
+			defer func() { tracing.End(action_span, err) }()
+			switch action_value.Action {
+			case alert.ActionAcknowledge:
+				err = h.acknowledge(action_ctx, card, l)
+			case alert.ActionResolve:
+				err = h.resolve(action_ctx, card, l)
+			case alert.ActionSilence:
+				err = h.silence(action_ctx, card, l, now, endsAt)
+			case alert.ActionExpireSilence:
+				err = h.expireSilence(action_ctx, card, l)
+			default:
+				log.Info().Msgf("ignore card action: %s", action_value.Action)
+				return
+			}
+			result := "succeeded"
+			if err != nil {
+				result = "failed"
+			}
+			metrics.CallbackActions.WithLabelValues(action_value.Action, result).Inc()
+		}()
+	} else {
+		log.Warn().Msgf("no card callback parsed, headers: %+v", c.Request.Header)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "ok",
+	})
+}
+
+// Wait waits for the running card actions until ctx is done.
+func (h *CallbackHandler) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.actions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("card actions are still running: %w", ctx.Err())
+	}
+}
+
+func (h *CallbackHandler) update(ctx context.Context, card *larkgin.CardActionTriggerEvent, l *alert.LarkCard) error {
+	cardStr := l.Card()
+	err := alert.UpdateCard(ctx, h.Bot, card.Event.Context.OpenMessageID, cardStr)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to update message %s", card.Event.Context.OpenMessageID)
+	}
+	return err
+}
+
+// card rebuilds the card the action was triggered on from its state.
+func (h *CallbackHandler) card(card *larkgin.CardActionTriggerEvent, v *alert.CardActionValue) (*alert.LarkCard, error) {
+	key := state.Key(card.Event.Context.OpenChatID, v.GroupKey, v.Fingerprint)
+	e, found, err := h.Store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !found || e.Card == nil {
+		return nil, fmt.Errorf("no card state of %s", key)
+	}
+	l := *e.Card
+	l.History = e.History
+	return &l, nil
+}
+
+// record stamps the operator of action onto the card history and persists it
+// with the card, so that later updates by the worker and card actions keep
+// it.
+func (h *CallbackHandler) record(card *larkgin.CardActionTriggerEvent, l *alert.LarkCard, action string, operator string) {
+	entry := alert.NewHistoryEntry(action, operator, card.Event.Operator.OpenID)
+	log.Info().Msgf("alert %s: %s", l.Fingerprint, entry)
+
+	chatID := card.Event.Context.OpenChatID
+	key := state.Key(chatID, l.GroupKey, l.Fingerprint)
+	err := h.Store.Update(key, func(e *state.Entry, found bool) error {
+		if !found {
+			*e = state.Entry{
+				MessageID:   card.Event.Context.OpenMessageID,
+				ChatID:      chatID,
+				GroupKey:    l.GroupKey,
+				Fingerprint: l.Fingerprint,
+				History:     l.History,
+			}
+		}
+		e.History = alert.AppendHistory(e.History, entry)
+		switch action {
+		case alert.ActionAcknowledge:
+			e.Acked = true
+		case alert.ActionResolve:
+			e.Acked = false
+		}
+		e.Status = l.Status
+		snapshot := *l
+		snapshot.History = nil
+		e.Card = &snapshot
+		e.UpdatedAt = time.Now()
+		l.History = e.History
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to save state of %s", key)
+		l.History = alert.AppendHistory(l.History, entry)
+	}
+}
+
+func (h *CallbackHandler) acknowledge(ctx context.Context, card *larkgin.CardActionTriggerEvent, l *alert.LarkCard) error {
+	h.record(card, l, alert.ActionAcknowledge, alert.OperatorName(ctx, h.Bot, card.Event.Operator.OpenID))
+	return h.update(ctx, card, l)
+}
+
+func (h *CallbackHandler) resolve(ctx context.Context, card *larkgin.CardActionTriggerEvent, l *alert.LarkCard) error {
+	l.Status = alert.StatusResolved
+	h.record(card, l, alert.ActionResolve, alert.OperatorName(ctx, h.Bot, card.Event.Operator.OpenID))
+	return h.update(ctx, card, l)
+}
+
+// silenceEnd returns when a silence requested by a card action should end,
+// either after one of the preset durations or at the time picked by the user.
+func silenceEnd(v *alert.CardActionValue, option string, now time.Time) (time.Time, error) {
+	var endsAt time.Time
+	if v.Duration != "" {
+		d, err := time.ParseDuration(v.Duration)
+		if err != nil {
+			return endsAt, fmt.Errorf("invalid silence duration %s: %w", v.Duration, err)
+		}
+		endsAt = now.Add(d)
+	} else {
+		t, err := parsePickerTime(option)
+		if err != nil {
+			return endsAt, fmt.Errorf("invalid silence end %q: %w", option, err)
+		}
+		endsAt = t
+	}
+	if !endsAt.After(now) {
+		return endsAt, fmt.Errorf("silence end %s is in the past", endsAt.Format(time.DateTime))
+	}
+	return endsAt, nil
+}
+
+func (h *CallbackHandler) silence(ctx context.Context, card *larkgin.CardActionTriggerEvent, l *alert.LarkCard, now, endsAt time.Time) error {
+	operator := alert.OperatorName(ctx, h.Bot, card.Event.Operator.OpenID)
+	operator_id := operator
+	if card.Event.Operator.OpenID != "" && operator != card.Event.Operator.OpenID {
+		operator_id = fmt.Sprintf("%s (%s)", operator, card.Event.Operator.OpenID)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	id, err := h.Alertmanager.CreateSilence(ctx, &alertmanager.Silence{
+		Matchers:  alertmanager.MatchersFromLabels(l.Labels),
+		StartsAt:  now,
+		EndsAt:    endsAt,
+		CreatedBy: operator_id,
+		Comment:   fmt.Sprintf("Silenced %s from lark by %s", l.Title, operator),
+	})
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to create silence for alert %s", l.Fingerprint)
+		return err
+	}
+	log.Info().Msgf("%s created silence %s for alert %s until %s", operator, id, l.Fingerprint, endsAt)
+
+	l.SilenceID = id
+	l.SilencedUntil = endsAt.Format("2006-01-02 15:04:05")
+	h.record(card, l, alert.ActionSilence, operator)
+	return h.update(ctx, card, l)
+}
+
+func (h *CallbackHandler) expireSilence(ctx context.Context, card *larkgin.CardActionTriggerEvent, l *alert.LarkCard) error {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := h.Alertmanager.ExpireSilence(ctx, l.SilenceID); err != nil {
+		log.Error().Err(err).Msgf("failed to expire silence %s", l.SilenceID)
+		return err
+	}
+	log.Info().Msgf("%s expired silence %s", card.Event.Operator.OpenID, l.SilenceID)
+
+	l.SilenceID = ""
+	l.SilencedUntil = ""
+	h.record(card, l, alert.ActionExpireSilence, alert.OperatorName(ctx, h.Bot, card.Event.Operator.OpenID))
+	return h.update(ctx, card, l)
+}
+
+// toast is the callback response that shows a toast to the operator.
+func toast(kind, content string) gin.H {
+	return gin.H{
+		"toast": gin.H{
+			"type":    kind,
+			"content": content,
+		},
+	}
+}
+
+func actionName(action string) string {
+	switch action {
+	case alert.ActionAcknowledge:
+		return "acknowledge"
+	case alert.ActionExpireSilence:
+		return "expire the silence of"
+	default:
+		return action
+	}
+}
+
+func parsePickerTime(s string) (time.Time, error) {
+	var err error
+	for _, layout := range pickerLayouts {
+		var t time.Time
+		if t, err = time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// cardActionOption returns action.option of the callback, which holds the
+// value picked in select menus and pickers. larkgin does not parse it.
+func cardActionOption(c *gin.Context) string {
+	body, err := c.GetRawData()
+	if err != nil {
+		return ""
+	}
+	if config.GlobalConfig.Lark.EncryptKey != "" {
+		var encrypted larkgin.EncryptEvent
+		if err := json.Unmarshal(body, &encrypted); err != nil || encrypted.Encrypt == "" {
+			return ""
+		}
+		body, err = lark.Decrypt(lark.EncryptKey(config.GlobalConfig.Lark.EncryptKey), encrypted.Encrypt)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to decrypt card callback")
+			return ""
+		}
+	}
+	var event struct {
+		Event struct {
+			Action struct {
+				Option string `json:"option"`
+			} `json:"action"`
+		} `json:"event"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return ""
+	}
+	return event.Event.Action.Option
+}
@@ -2,26 +2,50 @@ package server
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/404LifeFound/alertmanager-lark/config"
-	"github.com/404LifeFound/alertmanager-lark/internal/alert"
+	"github.com/404LifeFound/alertmanager-lark/internal/alertmanager"
+	"github.com/404LifeFound/alertmanager-lark/internal/health"
+	"github.com/404LifeFound/alertmanager-lark/internal/metrics"
+	"github.com/404LifeFound/alertmanager-lark/internal/mq"
+	"github.com/404LifeFound/alertmanager-lark/internal/policy"
+	"github.com/404LifeFound/alertmanager-lark/internal/route"
+	"github.com/404LifeFound/alertmanager-lark/internal/state"
+	"github.com/404LifeFound/alertmanager-lark/internal/tracing"
 	larkgin "github.com/404LifeFound/lark-gin/v2"
 	"github.com/gin-gonic/gin"
 	"github.com/go-lark/lark"
 	"github.com/prometheus/alertmanager/notify/webhook"
 	"github.com/rs/zerolog/log"
-	kafka "github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
 )
 
 type WebhookHandler struct {
-	Writer *kafka.Writer
+	Producer  mq.Producer
+	Spool     *mq.Spool
+	Receivers route.Receivers
 }
 
 func (w *WebhookHandler) Webhook(c *gin.Context) {
+	ctx, span := tracing.Tracer.Start(
+		tracing.Extract(c.Request.Context(), c.GetHeader(mq.HeaderTraceParent), c.GetHeader(mq.HeaderTraceState)),
+		"webhook", trace.WithSpanKind(trace.SpanKindServer))
+	defer func() {
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		var err error
+		if e := c.Errors.Last(); e != nil && status >= http.StatusInternalServerError {
+			err = e.Err
+		}
+		tracing.End(span, err)
+	}()
+
 	var webhook_event webhook.Message
 	if err := c.ShouldBindBodyWithJSON(&webhook_event); err != nil {
 		c.Error(err)
@@ -31,8 +55,55 @@ func (w *WebhookHandler) Webhook(c *gin.Context) {
 		})
 		return
 	}
+	if webhook_event.Data == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+			"message": "webhook event is not valid",
+			"error":   "webhook event has no alerts",
+		})
+		return
+	}
 
-	kafka_msg, err := json.Marshal(webhook_event)
+	route_name := c.Param("route")
+	if route_name != "" {
+		if _, ok := w.Receivers.Lookup(route_name); !ok {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"message": "webhook route is not configured",
+				"error":   fmt.Sprintf("unknown route %s", route_name),
+			})
+			return
+		}
+	} else if _, ok := w.Receivers.Lookup(webhook_event.Receiver); ok {
+		route_name = webhook_event.Receiver
+	}
+
+	request_id := c.GetHeader(requestIDHeader)
+	if request_id == "" {
+		request_id = newRequestID()
+	}
+	c.Header(requestIDHeader, request_id)
+	span.SetAttributes(
+		attribute.String("route", route_name),
+		attribute.String("request_id", request_id),
+		attribute.String("group_key", webhook_event.GroupKey),
+		attribute.Int("alerts", len(webhook_event.Alerts)),
+	)
+	trace_parent, trace_state := tracing.Inject(ctx)
+	var body []byte
+	if b, ok := c.Get(gin.BodyBytesKey); ok {
+		body, _ = b.([]byte)
+	}
+
+	receiver, _ := w.Receivers.Lookup(route_name)
+	msgs, err := records(&webhook_event, &mq.Envelope{
+		Version:     mq.EnvelopeVersion,
+		ReceivedAt:  time.Now().UTC(),
+		SourceIP:    c.ClientIP(),
+		Route:       route_name,
+		RequestID:   request_id,
+		TraceParent: trace_parent,
+		TraceState:  trace_state,
+		BodySHA256:  mq.BodySHA256(body),
+	}, receiver)
 	if err != nil {
 		c.Error(err)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
@@ -42,11 +113,11 @@ func (w *WebhookHandler) Webhook(c *gin.Context) {
 		return
 	}
 
-	var key []byte
-	if len(webhook_event.Alerts) > 0 {
-		if fp := webhook_event.Alerts[0].Fingerprint; fp != "" {
-			key = []byte(fp)
-		}
+	// records spooled earlier are flushed first, later records queue up
+	// behind them to keep their order
+	if w.Spool.Pending() {
+		w.spool(c, msgs, nil)
+		return
 	}
 
 	retries := config.GlobalConfig.Kafka.WriteRetries
@@ -54,51 +125,137 @@ func (w *WebhookHandler) Webhook(c *gin.Context) {
 		retries = 1
 	}
 	backoff := time.Duration(config.GlobalConfig.Kafka.WriteRetryBackoff) * time.Millisecond
+	backend := queueBackend()
 	var lastErr error
 	for attempt := 1; attempt <= retries; attempt++ {
-		ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
-		err = w.Writer.WriteMessages(ctx,
-			kafka.Message{
-				Key:   key,
-				Value: kafka_msg,
-			},
-		)
+		if attempt > 1 {
+			metrics.QueueWriteRetries.WithLabelValues(backend).Inc()
+		}
+		write_ctx, write_span := tracing.Tracer.Start(ctx, "queue write", trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(
+				attribute.String("backend", backend),
+				attribute.Int("attempt", attempt),
+				attribute.Int("messages", len(msgs)),
+			))
+		write_ctx, cancel := context.WithTimeout(write_ctx, 3*time.Second)
+		start := time.Now()
+		err = w.Producer.Produce(write_ctx, msgs...)
+		metrics.QueueWriteDuration.WithLabelValues(backend).Observe(time.Since(start).Seconds())
 		cancel()
+		tracing.End(write_span, err)
 		if err == nil {
 			lastErr = nil
 			break
 		}
 		lastErr = err
+		if errors.Is(err, mq.ErrQueueFull) {
+			// direct delivery is backed up, let alertmanager retry later
+			break
+		}
 		if attempt < retries {
 			time.Sleep(backoff)
 		}
 	}
+	if lastErr != nil {
+		metrics.QueueWriteFailures.WithLabelValues(backend).Inc()
+	}
+	if errors.Is(lastErr, mq.ErrQueueFull) {
+		c.Error(lastErr)
+		c.Header("Retry-After", "10")
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+			"message": "delivery queue is full",
+			"error":   lastErr.Error(),
+		})
+		return
+	}
+	if lastErr != nil && w.Spool.Enabled() {
+		w.spool(c, msgs, lastErr)
+		return
+	}
 	if lastErr != nil {
 		c.Error(lastErr)
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-			"message": "write event to kafka failed",
+			"message": "write event to queue failed",
 			"error":   lastErr.Error(),
 		})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "received event and write to kafka successful",
+		"message": "received event and write to queue successful",
 		"error":   "",
 	})
 }
 
-func RegisterHandlers(e *gin.Engine, w *kafka.Writer, bot *lark.Bot) error {
+// queueBackend is the backend label of the queue write metrics.
+func queueBackend() string {
+	if config.GlobalConfig.Delivery.Mode == mq.DeliveryDirect {
+		return mq.DeliveryDirect
+	}
+	if config.GlobalConfig.Queue.Backend == "" {
+		return mq.BackendKafka
+	}
+	return config.GlobalConfig.Queue.Backend
+}
+
+// spool accepts msgs into the spool, they are written to the queue once it
+// can be written to again.
+func (w *WebhookHandler) spool(c *gin.Context, msgs []mq.Message, queueErr error) {
+	if queueErr != nil {
+		log.Warn().Err(queueErr).Msg("write event to queue failed, spooling it on disk")
+	}
+	if err := w.Spool.Add(c.Request.Context(), msgs...); err != nil {
+		c.Error(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+			"message": "write event to spool failed",
+			"error":   errors.Join(queueErr, err).Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "received event and spooled it until the queue recovers",
+		"error":   "",
+	})
+}
+
+// healthReport responds with report, 503 when a component failed.
+func healthReport(c *gin.Context, report health.Report) {
+	code := http.StatusOK
+	if report.Status != health.StatusOK {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, report)
+}
+
+func registerHealth(e *gin.Engine, registry *health.Registry) {
 	e.GET("/healthz", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"status": "ok",
 		})
 	})
+	e.GET("/readyz", func(c *gin.Context) {
+		healthReport(c, registry.Ready(c.Request.Context()))
+	})
+	e.GET("/livez", func(c *gin.Context) {
+		healthReport(c, registry.Live(c.Request.Context()))
+	})
+}
+
+func RegisterHandlers(lc fx.Lifecycle, e *gin.Engine, producer mq.Producer, spool *mq.Spool, bot *lark.Bot, receivers route.Receivers, am *alertmanager.Client, store state.Store, p *policy.Policy, registry *health.Registry) error {
+	registerHealth(e, registry)
 	webhook_handler := &WebhookHandler{
-		Writer: w,
+		Producer:  producer,
+		Spool:     spool,
+		Receivers: receivers,
+	}
+	auth, err := webhookAuthMiddleware()
+	if err != nil {
+		return err
 	}
 	g := e.Group("/lark", nil)
+	g.Use(webhookMetrics(receivers), auth)
 	g.POST("/webhook", webhook_handler.Webhook)
+	g.POST("/webhook/:route", webhook_handler.Webhook)
 
 	middleware := larkgin.NewLarkMiddleware()
 
@@ -111,74 +268,20 @@ func RegisterHandlers(e *gin.Engine, w *kafka.Writer, bot *lark.Bot) error {
 	}
 
 	eventGroup := e.Group("/event")
-	eventGroup.Use(middleware.LarkChallengeHandler(), middleware.LarkCardHandler())
-	eventGroup.POST("/callback", func(c *gin.Context) {
-		if card, ok := middleware.GetCardCallback(c); ok {
-			log.Info().Msgf("received lark card callback: %+v", card)
-			var action_value alert.CardActionValue
-
-			err := json.Unmarshal(card.Event.Action.Value, &action_value)
-			if err != nil {
-				log.Error().Msgf("can't unmarshal card action value to CardActionValue: %v", err)
-				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
-					"message": "invalid action request",
-					"error":   err.Error(),
-				})
-				return
-			}
-
-			go func() {
-				if action_value.Action != "resolve" {
-					log.Info().Msgf("ignore card action: %s", action_value.Action)
-					return
-				}
-				resolved := &alert.LarkCard{
-					Title:        action_value.Title,
-					Project:      action_value.Project,
-					Time:         action_value.Time,
-					GrafanaURL:   action_value.GrafanaURL,
-					RunBookURL:   action_value.RunBookURL,
-					Metric:       action_value.Metric,
-					Description:  action_value.Description,
-					AssignEmails: nil,
-				}
-				cardStr := resolved.NewResolvedCard()
-				retries := config.GlobalConfig.Lark.SendRetries
-				if retries <= 0 {
-					retries = 1
-				}
-				backoff := time.Duration(config.GlobalConfig.Lark.SendRetryBackoff) * time.Millisecond
-				var updateErr error
-				var resp *lark.UpdateMessageResponse
-				for attempt := 1; attempt <= retries; attempt++ {
-					resp, updateErr = bot.UpdateMessage(card.Event.Context.OpenMessageID,
-						lark.NewMsgBuffer(lark.MsgInteractive).
-							Card(cardStr).
-							Build(),
-					)
-					if updateErr == nil {
-						if resp != nil && resp.Code != 0 {
-							updateErr = fmt.Errorf("lark api error on update: code=%d, msg=%s", resp.Code, resp.Msg)
-						}
-					}
-					if updateErr == nil {
-						break
-					}
-					if attempt < retries {
-						time.Sleep(backoff)
-					}
-				}
-				if updateErr != nil {
-					log.Error().Err(updateErr).Msgf("failed to update message %s", card.Event.Context.OpenMessageID)
-				}
-			}()
-		} else {
-			log.Warn().Msgf("no card callback parsed, headers: %+v", c.Request.Header)
-		}
-
-		c.JSON(http.StatusOK, gin.H{
-			"message": "ok",
-		})
+	eventGroup.Use(middleware.LarkChallengeHandler(), callbackVerifyMiddleware(), middleware.LarkCardHandler())
+	callback_handler := &CallbackHandler{
+		Bot:          bot,
+		Alertmanager: am,
+		Store:        store,
+		Policy:       p,
+		Middleware:   middleware,
+	}
+	eventGroup.POST("/callback", callback_handler.Callback)
+	lc.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			log.Info().Msg("waiting for running card actions")
+			return callback_handler.Wait(ctx)
+		},
 	})
 
 	return nil
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config/configtest"
+	"github.com/404LifeFound/alertmanager-lark/internal/mq"
+	"github.com/404LifeFound/alertmanager-lark/internal/route"
+	"github.com/gin-gonic/gin"
+)
+
+const notificationBody = `{
+	"version": "4",
+	"receiver": "team",
+	"status": "firing",
+	"groupKey": "{}:{alertname=\"DiskFull\"}",
+	"alerts": [{"status": "firing", "labels": {"alertname": "DiskFull"}, "fingerprint": "fp1"}]
+}`
+
+func postNotification(e *gin.Engine) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(notificationBody)))
+	return w
+}
+
+func TestWebhookDirectDelivery(t *testing.T) {
+	cfg := configtest.Set(t)
+	cfg.Delivery.Mode = mq.DeliveryDirect
+	cfg.Kafka.WriteRetries = 3
+	cfg.Kafka.WriteRetryBackoff = int(time.Second / time.Millisecond)
+	queue := mq.NewDirectQueue(1)
+	h := &WebhookHandler{Producer: queue, Receivers: route.Receivers{"team": {Name: "team"}}}
+	e := gin.New()
+	e.POST("/webhook", h.Webhook)
+
+	if w := postNotification(e); w.Code != http.StatusOK {
+		t.Fatalf("queued notification: got status %d: %s", w.Code, w.Body)
+	}
+	m, err := queue.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route := mq.HeaderValue(m, mq.HeaderRoute); route != "team" || string(m.Key) != "fp1" {
+		t.Errorf("queued record of route %q keyed %q", route, m.Key)
+	}
+
+	// the queue holds one record, the workers are backed up
+	if w := postNotification(e); w.Code != http.StatusOK {
+		t.Fatalf("queued notification: got status %d: %s", w.Code, w.Body)
+	}
+	start := time.Now()
+	w := postNotification(e)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("notification to a full queue: got status %d with Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("write to the full queue was retried, the request took %s", elapsed)
+	}
+	if n, _ := queue.Lag(context.Background()); n != 1 {
+		t.Errorf("queue holds %d records, want 1", n)
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/404LifeFound/alertmanager-lark/config/configtest"
+	"github.com/404LifeFound/alertmanager-lark/internal/health"
+	"github.com/gin-gonic/gin"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	cfg := configtest.Set(t)
+	cfg.Health.CacheSeconds = 60
+	registry := health.NewRegistry()
+	var ready, alive error
+	registry.Readiness("kafka", func(context.Context) error { return ready })
+	registry.Liveness("consumer", func(context.Context) error { return alive })
+	e := gin.New()
+	registerHealth(e, registry)
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	ready = errors.New("no kafka broker is reachable")
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz with a failing check: got status %d", code)
+	}
+	// the failed report is served until the cache time ran out
+	ready = nil
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("cached /readyz: got status %d", code)
+	}
+
+	if code := get("/livez"); code != http.StatusOK {
+		t.Errorf("/livez: got status %d", code)
+	}
+	alive = errors.New("worker 0 is stuck on a message for 5m0s")
+	if code := get("/livez"); code != http.StatusServiceUnavailable {
+		t.Errorf("/livez with a stuck worker: got status %d", code)
+	}
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz: got status %d", code)
+	}
+}
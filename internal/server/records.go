@@ -0,0 +1,112 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"slices"
+	"strconv"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/internal/alert"
+	"github.com/404LifeFound/alertmanager-lark/internal/mq"
+	"github.com/404LifeFound/alertmanager-lark/internal/route"
+	"github.com/prometheus/alertmanager/notify/webhook"
+	"github.com/prometheus/alertmanager/template"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// records turns a notification into queue records. With fan out every
+// alert becomes a record of its own keyed by fingerprint, unless the
+// receiver renders grouped cards which need the whole notification.
+//
+// The records are wrapped in a copy of meta, or written in the legacy
+// format when envelopes are disabled.
+func records(webhook_event *webhook.Message, meta *mq.Envelope, receiver *route.Receiver) ([]mq.Message, error) {
+	headers := []mq.Header{
+		{Key: mq.HeaderGroupKey, Value: []byte(webhook_event.GroupKey)},
+	}
+	if meta.Route != "" {
+		headers = append(headers, mq.Header{Key: mq.HeaderRoute, Value: []byte(meta.Route)})
+	}
+	// trace context travels in the headers in the legacy format too
+	if meta.TraceParent != "" {
+		headers = append(headers, mq.Header{Key: mq.HeaderTraceParent, Value: []byte(meta.TraceParent)})
+	}
+	if meta.TraceState != "" {
+		headers = append(headers, mq.Header{Key: mq.HeaderTraceState, Value: []byte(meta.TraceState)})
+	}
+
+	mode := config.GlobalConfig.Card.Mode
+	if receiver != nil && receiver.Mode != "" {
+		mode = receiver.Mode
+	}
+	alerts := webhook_event.Alerts
+	if !config.GlobalConfig.Queue.FanOut || mode == alert.ModeGrouped || len(alerts) == 0 {
+		var key []byte
+		if config.GlobalConfig.Queue.FanOut && webhook_event.GroupKey != "" {
+			key = []byte(webhook_event.GroupKey)
+		} else if len(alerts) > 0 {
+			if fp := alerts[0].Fingerprint; fp != "" {
+				key = []byte(fp)
+			}
+		}
+		m, err := record(webhook_event, meta, key, headers)
+		if err != nil {
+			return nil, err
+		}
+		return []mq.Message{m}, nil
+	}
+
+	msgs := make([]mq.Message, 0, len(alerts))
+	size := strconv.Itoa(len(alerts))
+	for i, a := range alerts {
+		single := *webhook_event
+		data := *webhook_event.Data
+		data.Alerts = template.Alerts{a}
+		single.Data = &data
+		m, err := record(&single, meta, []byte(a.Fingerprint), append(slices.Clone(headers),
+			mq.Header{Key: mq.HeaderGroupStatus, Value: []byte(webhook_event.Status)},
+			mq.Header{Key: mq.HeaderGroupSize, Value: []byte(size)},
+			mq.Header{Key: mq.HeaderAlertIndex, Value: []byte(strconv.Itoa(i))},
+			mq.Header{Key: mq.HeaderFingerprint, Value: []byte(a.Fingerprint)},
+		))
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+func record(webhook_event *webhook.Message, meta *mq.Envelope, key []byte, headers []mq.Header) (mq.Message, error) {
+	payload, err := json.Marshal(webhook_event)
+	if err != nil {
+		return mq.Message{}, err
+	}
+	if !config.GlobalConfig.Queue.Envelope {
+		return mq.Message{Key: key, Value: payload, Headers: headers}, nil
+	}
+
+	envelope := *meta
+	envelope.Payload = payload
+	value, err := json.Marshal(&envelope)
+	if err != nil {
+		return mq.Message{}, err
+	}
+	for _, h := range envelope.Headers() {
+		switch h.Key {
+		case mq.HeaderRoute, mq.HeaderTraceParent, mq.HeaderTraceState:
+		default:
+			headers = append(headers, h)
+		}
+	}
+	return mq.Message{Key: key, Value: value, Headers: headers}, nil
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config/configtest"
+	"github.com/404LifeFound/alertmanager-lark/internal/alert"
+	"github.com/404LifeFound/alertmanager-lark/internal/mq"
+	"github.com/404LifeFound/alertmanager-lark/internal/route"
+	"github.com/prometheus/alertmanager/notify/webhook"
+	"github.com/prometheus/alertmanager/template"
+)
+
+func notification(fingerprints ...string) *webhook.Message {
+	var alerts template.Alerts
+	for _, fp := range fingerprints {
+		alerts = append(alerts, template.Alert{Status: alert.StatusFiring, Fingerprint: fp})
+	}
+	return &webhook.Message{
+		Data:     &template.Data{Receiver: "team", Status: alert.StatusFiring, Alerts: alerts},
+		Version:  "4",
+		GroupKey: "{}:{alertname=\"DiskFull\"}",
+	}
+}
+
+func meta() *mq.Envelope {
+	return &mq.Envelope{
+		Version:     mq.EnvelopeVersion,
+		ReceivedAt:  time.Now().UTC(),
+		Route:       "team",
+		RequestID:   "r1",
+		TraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	}
+}
+
+// payload decodes the webhook message of a record in either format.
+func payload(t *testing.T, m mq.Message) (*mq.Envelope, webhook.Message) {
+	t.Helper()
+	e, err := mq.OpenEnvelope(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg webhook.Message
+	if err := json.Unmarshal(e.Payload, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return e, msg
+}
+
+func TestRecordsFanOutPerAlert(t *testing.T) {
+	configtest.Set(t).Queue.FanOut = true
+	event := notification("fp1", "fp2", "fp3")
+
+	msgs, err := records(event, meta(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 {
+		t.Fatalf("want a record per alert, got %d", len(msgs))
+	}
+	for i, m := range msgs {
+		fp := event.Alerts[i].Fingerprint
+		if string(m.Key) != fp {
+			t.Errorf("record %d is keyed %q, want %s", i, m.Key, fp)
+		}
+		for key, want := range map[string]string{
+			mq.HeaderFingerprint: fp,
+			mq.HeaderGroupKey:    event.GroupKey,
+			mq.HeaderGroupStatus: alert.StatusFiring,
+			mq.HeaderGroupSize:   "3",
+			mq.HeaderAlertIndex:  strconv.Itoa(i),
+			mq.HeaderRoute:       "team",
+			mq.HeaderTraceParent: meta().TraceParent,
+		} {
+			if got := mq.HeaderValue(m, key); got != want {
+				t.Errorf("record %d has %s %q, want %q", i, key, got, want)
+			}
+		}
+		e, msg := payload(t, m)
+		if e.Version != 0 {
+			t.Errorf("record %d is wrapped without queue.envelope", i)
+		}
+		if len(msg.Alerts) != 1 || msg.Alerts[0].Fingerprint != fp || msg.GroupKey != event.GroupKey {
+			t.Errorf("record %d holds %+v", i, msg)
+		}
+	}
+}
+
+func TestRecordsWithoutFanOut(t *testing.T) {
+	grouped := &route.Receiver{Name: "team", Mode: alert.ModeGrouped}
+	tests := []struct {
+		name     string
+		fanOut   bool
+		receiver *route.Receiver
+		key      string
+	}{
+		{"fan out disabled", false, nil, "fp1"},
+		{"grouped receiver", true, grouped, notification().GroupKey},
+	}
+	for _, tt := range tests {
+		configtest.Set(t).Queue.FanOut = tt.fanOut
+		msgs, err := records(notification("fp1", "fp2"), meta(), tt.receiver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 1 {
+			t.Errorf("%s: want one record, got %d", tt.name, len(msgs))
+			continue
+		}
+		if string(msgs[0].Key) != tt.key {
+			t.Errorf("%s: record is keyed %q, want %q", tt.name, msgs[0].Key, tt.key)
+		}
+		if fp := mq.HeaderValue(msgs[0], mq.HeaderFingerprint); fp != "" {
+			t.Errorf("%s: record has fingerprint header %s", tt.name, fp)
+		}
+		if _, msg := payload(t, msgs[0]); len(msg.Alerts) != 2 {
+			t.Errorf("%s: record holds %d alerts, want 2", tt.name, len(msg.Alerts))
+		}
+	}
+}
+
+func TestRecordsInEnvelope(t *testing.T) {
+	cfg := configtest.Set(t)
+	cfg.Queue.FanOut = true
+	cfg.Queue.Envelope = true
+
+	msgs, err := records(notification("fp1", "fp2"), meta(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range msgs {
+		if v := mq.HeaderValue(m, mq.HeaderEnvelopeVersion); v != "1" {
+			t.Errorf("record %d has envelope version header %q", i, v)
+		}
+		if id := mq.HeaderValue(m, mq.HeaderRequestID); id != "r1" {
+			t.Errorf("record %d has request id header %q", i, id)
+		}
+		seen := map[string]int{}
+		for _, h := range m.Headers {
+			seen[h.Key]++
+		}
+		for key, n := range seen {
+			if n > 1 {
+				t.Errorf("record %d has %d %s headers", i, n, key)
+			}
+		}
+		e, msg := payload(t, m)
+		if e.Version != mq.EnvelopeVersion || e.Route != "team" || e.RequestID != "r1" {
+			t.Errorf("record %d has envelope %+v", i, e)
+		}
+		if len(msg.Alerts) != 1 || msg.Alerts[0].Fingerprint != []string{"fp1", "fp2"}[i] {
+			t.Errorf("record %d holds %+v", i, msg)
+		}
+	}
+}
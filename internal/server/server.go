@@ -5,85 +5,242 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
-	"encoding/base64"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/internal/metrics"
+	"github.com/404LifeFound/alertmanager-lark/internal/route"
 	"github.com/gin-contrib/logger"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"go.uber.org/fx"
 )
 
-func NewGinEngine(lc fx.Lifecycle) *gin.Engine {
+func NewGinEngine() *gin.Engine {
 	e := gin.New()
 	e.Use(
 		logger.SetLogger(logger.WithLogger(func(_ *gin.Context, l zerolog.Logger) zerolog.Logger {
 			return l.Output(gin.DefaultWriter).With().Logger()
-		}), logger.WithSkipPath([]string{"/healthz"})), // We can now safely log /lark/callback
+		}), logger.WithSkipPath([]string{"/healthz", "/readyz", "/livez", "/metrics"})), // We can now safely log /lark/callback
 		gin.Recovery(),
 	)
+	e.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	return e
+}
+
+// Serve runs the http server of e, over https when a certificate is
+// configured. Shutdown waits for the requests being handled, so webhooks are
+// written to the queue before it is closed.
+func Serve(lc fx.Lifecycle, e *gin.Engine) error {
 	srv := &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", config.GlobalConfig.Http.Host, config.GlobalConfig.Http.Port),
 		Handler: e,
 	}
+	tc, err := serverTLS()
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = tc
 
 	lc.Append(fx.Hook{
 		OnStart: func(context.Context) error {
 			go func() {
-				if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				var err error
+				if srv.TLSConfig != nil {
+					err = srv.ListenAndServeTLS("", "")
+				} else {
+					err = srv.ListenAndServe()
+				}
+				if err != nil && err != http.ErrServerClosed {
 					panic(err)
 				}
 			}()
 			return nil
 		},
 		OnStop: func(ctx context.Context) error {
+			log.Info().Msg("stopping http server")
 			return srv.Shutdown(ctx)
 		},
 	})
-	return e
+	return nil
+}
+
+// serverTLS returns the tls config of http.tls, nil serves plain http.
+// Client certificates are verified when presented but not required, lark
+// callbacks come without one.
+func serverTLS() (*tls.Config, error) {
+	c := config.GlobalConfig.Http.TLS
+	if c.CertFile == "" && c.KeyFile == "" {
+		if c.ClientCAFile != "" {
+			return nil, fmt.Errorf("http.tls.clientCAFile needs http.tls.certFile and keyFile")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load http tls certificate: %w", err)
+	}
+	tc := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read http tls client ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", c.ClientCAFile)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tc, nil
 }
 
-func bodyLogMiddleware() gin.HandlerFunc {
+// webhookMetrics counts webhook requests by route and status code. Unknown
+// routes are counted as "unknown" to keep the label bounded.
+func webhookMetrics(receivers route.Receivers) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if c.Request.URL.Path == "/event/callback" && c.Request.Body != nil {
-			bodyBytes, err := io.ReadAll(c.Request.Body)
-			if err != nil {
-				log.Error().Err(err).Msg("failed to read request body for buffering")
-				c.Next()
-				return
-			}
-			log.Info().
-				Int("buffered_body_size", len(bodyBytes)).
-				Str("buffered_body_content", string(bodyBytes)).
-				Msg("request body buffered")
-			if config.GlobalConfig.Lark.VerificationToken != "" {
-				nonce := c.Request.Header.Get("X-Lark-Request-Nonce")
-				timestamp := c.Request.Header.Get("X-Lark-Request-Timestamp")
-				signature := c.Request.Header.Get("X-Lark-Signature")
-				mac := hmac.New(sha256.New, []byte(config.GlobalConfig.Lark.VerificationToken))
-				mac.Write([]byte(timestamp))
-				mac.Write([]byte(nonce))
-				mac.Write(bodyBytes)
-				expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
-				abbr := func(s string) string {
-					if len(s) > 8 {
-						return s[:8] + "..."
-					}
-					return s
-				}
-				log.Info().
-					Str("req_sig_prefix", abbr(signature)).
-					Str("exp_sig_prefix", abbr(expected)).
-					Bool("sig_matched", expected == signature).
-					Msg("token verification precheck for card callback")
-			}
-			c.Request.Body.Close()
-			c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-			c.Request.ContentLength = int64(len(bodyBytes))
+		c.Next()
+		route_name := c.Param("route")
+		if route_name == "" {
+			route_name = "default"
+		} else if _, ok := receivers.Lookup(route_name); !ok {
+			route_name = "unknown"
+		}
+		metrics.WebhookRequests.WithLabelValues(route_name, strconv.Itoa(c.Writer.Status())).Inc()
+		if c.Request.ContentLength >= 0 {
+			metrics.WebhookPayloadBytes.WithLabelValues(route_name).Observe(float64(c.Request.ContentLength))
+		}
+	}
+}
+
+// nonceCache remembers the nonces of recent callbacks, the oldest nonce is
+// evicted once size is reached.
+type nonceCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	seen  map[string]time.Time
+	order []string
+}
+
+func newNonceCache(size int, ttl time.Duration) *nonceCache {
+	if size <= 0 {
+		size = 10000
+	}
+	return &nonceCache{
+		size: size,
+		ttl:  ttl,
+		seen: make(map[string]time.Time, size),
+	}
+}
+
+// Add records nonce and reports false when it was already seen within ttl.
+func (n *nonceCache) Add(nonce string, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if t, ok := n.seen[nonce]; ok && now.Sub(t) <= n.ttl {
+		return false
+	}
+	if _, ok := n.seen[nonce]; !ok {
+		if len(n.order) >= n.size {
+			delete(n.seen, n.order[0])
+			n.order = n.order[1:]
+		}
+		n.order = append(n.order, nonce)
+	}
+	n.seen[nonce] = now
+	return true
+}
+
+func callbackSignature(timestamp, nonce, encryptKey string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(timestamp))
+	h.Write([]byte(nonce))
+	h.Write([]byte(encryptKey))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// callbackVerifyMiddleware rejects lark callbacks with an invalid
+// X-Lark-Signature, a stale X-Lark-Request-Timestamp or a reused nonce.
+// Lark signs callbacks with the encrypt key, the server doesn't start without
+// it and callbacks are rejected should it be missing anyway.
+func callbackVerifyMiddleware() gin.HandlerFunc {
+	reject := func(c *gin.Context, reason string, err error) {
+		metrics.CallbackRejected.WithLabelValues(reason).Inc()
+		log.Warn().Err(err).Str("reason", reason).Str("client_ip", c.ClientIP()).Msg("rejected lark card callback")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"message": "card callback verification failed",
+			"error":   err.Error(),
+		})
+	}
+
+	encryptKey := config.GlobalConfig.Lark.EncryptKey
+	if encryptKey == "" {
+		log.Error().Msg("lark encrypt key is not configured, card callbacks can't be verified and are rejected")
+		return func(c *gin.Context) {
+			reject(c, "not_configured", fmt.Errorf("lark encrypt key is not configured"))
+		}
+	}
+	window := time.Duration(config.GlobalConfig.Lark.CallbackMaxSkewSeconds) * time.Second
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+	nonces := newNonceCache(config.GlobalConfig.Lark.CallbackNonceCacheSize, 2*window)
+
+	return func(c *gin.Context) {
+		nonce := c.Request.Header.Get("X-Lark-Request-Nonce")
+		timestamp := c.Request.Header.Get("X-Lark-Request-Timestamp")
+		signature := c.Request.Header.Get("X-Lark-Signature")
+		if nonce == "" || timestamp == "" || signature == "" {
+			reject(c, "missing_headers", fmt.Errorf("missing signature headers"))
+			return
+		}
+
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			reject(c, "invalid_timestamp", fmt.Errorf("invalid timestamp %q", timestamp))
+			return
+		}
+		now := time.Now()
+		if skew := now.Sub(time.Unix(ts, 0)); skew > window || skew < -window {
+			reject(c, "stale_timestamp", fmt.Errorf("timestamp %s is outside of the %s window", timestamp, window))
+			return
+		}
+
+		bodyBytes, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			reject(c, "read_body", err)
+			return
+		}
+		c.Request.Body.Close()
+		c.Request.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+		c.Request.ContentLength = int64(len(bodyBytes))
+
+		expected := callbackSignature(timestamp, nonce, encryptKey, bodyBytes)
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			reject(c, "invalid_signature", fmt.Errorf("signature mismatch"))
+			return
+		}
+
+		if !nonces.Add(nonce, now) {
+			reject(c, "replayed_nonce", fmt.Errorf("nonce %s was already used", nonce))
+			return
 		}
 		c.Next()
 	}
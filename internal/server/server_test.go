@@ -0,0 +1,122 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config/configtest"
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func callbackEngine() *gin.Engine {
+	e := gin.New()
+	e.POST("/lark/callback", callbackVerifyMiddleware(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	return e
+}
+
+// callback sends body signed with key, the timestamp and nonce headers are
+// left out when empty.
+func callback(e *gin.Engine, key string, timestamp time.Time, nonce string, body string) int {
+	r := httptest.NewRequest(http.MethodPost, "/lark/callback", strings.NewReader(body))
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	if nonce != "" {
+		r.Header.Set("X-Lark-Request-Nonce", nonce)
+		r.Header.Set("X-Lark-Request-Timestamp", ts)
+		r.Header.Set("X-Lark-Signature", callbackSignature(ts, nonce, key, []byte(body)))
+	}
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestCallbackVerification(t *testing.T) {
+	cfg := configtest.Set(t)
+	cfg.Lark.EncryptKey = "encrypt-key"
+	cfg.Lark.CallbackMaxSkewSeconds = 60
+	e := callbackEngine()
+	now := time.Now()
+	body := `{"action": {"value": {"action": "ack"}}}`
+
+	tests := []struct {
+		name      string
+		key       string
+		timestamp time.Time
+		nonce     string
+		want      int
+	}{
+		{"signed", "encrypt-key", now, "n1", http.StatusOK},
+		{"replayed nonce", "encrypt-key", now, "n1", http.StatusUnauthorized},
+		{"wrong key", "other-key", now, "n2", http.StatusUnauthorized},
+		{"unsigned", "", now, "", http.StatusUnauthorized},
+		{"stale", "encrypt-key", now.Add(-2 * time.Minute), "n3", http.StatusUnauthorized},
+		{"from the future", "encrypt-key", now.Add(2 * time.Minute), "n4", http.StatusUnauthorized},
+		{"within the skew", "encrypt-key", now.Add(-30 * time.Second), "n5", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := callback(e, tt.key, tt.timestamp, tt.nonce, body); got != tt.want {
+			t.Errorf("%s callback: got status %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCallbackTamperedBody(t *testing.T) {
+	cfg := configtest.Set(t)
+	cfg.Lark.EncryptKey = "encrypt-key"
+	e := callbackEngine()
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	r := httptest.NewRequest(http.MethodPost, "/lark/callback", strings.NewReader(`{"action": "resolve"}`))
+	r.Header.Set("X-Lark-Request-Nonce", "n1")
+	r.Header.Set("X-Lark-Request-Timestamp", ts)
+	r.Header.Set("X-Lark-Signature", callbackSignature(ts, "n1", "encrypt-key", []byte(`{"action": "ack"}`)))
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("tampered callback: got status %d", w.Code)
+	}
+}
+
+func TestCallbackWithoutEncryptKey(t *testing.T) {
+	cfg := configtest.Set(t)
+	cfg.Lark.EncryptKey = ""
+	e := callbackEngine()
+
+	if got := callback(e, "", time.Now(), "n1", `{}`); got != http.StatusUnauthorized {
+		t.Errorf("callback without a configured encrypt key: got status %d", got)
+	}
+	if got := callback(e, "", time.Now(), "", `{}`); got != http.StatusUnauthorized {
+		t.Errorf("unsigned callback without a configured encrypt key: got status %d", got)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	n := newNonceCache(2, time.Hour)
+	now := time.Now()
+	for _, nonce := range []string{"a", "b", "c"} {
+		if !n.Add(nonce, now) {
+			t.Fatalf("new nonce %s was rejected", nonce)
+		}
+	}
+	if n.Add("c", now) {
+		t.Error("cached nonce was accepted")
+	}
+	if !n.Add("a", now) {
+		t.Error("evicted nonce was rejected")
+	}
+
+	n = newNonceCache(10, time.Minute)
+	n.Add("a", now)
+	if !n.Add("a", now.Add(2*time.Minute)) {
+		t.Error("expired nonce was rejected")
+	}
+}
@@ -0,0 +1,140 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var alertsBucket = []byte("alerts")
+
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(alertsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Check runs an empty write transaction, it fails when the database can't
+// be written to.
+func (s *BoltStore) Check(ctx context.Context) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(alertsBucket) == nil {
+			return fmt.Errorf("bucket %s is missing", alertsBucket)
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Get(key string) (*Entry, bool, error) {
+	var e *Entry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(alertsBucket).Get([]byte(key))
+		if v == nil {
+			return nil
+		}
+		e = &Entry{}
+		return json.Unmarshal(v, e)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return e, e != nil, nil
+}
+
+func (s *BoltStore) Put(key string, e *Entry) error {
+	if e.UpdatedAt.IsZero() {
+		e.UpdatedAt = time.Now()
+	}
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(alertsBucket).Put([]byte(key), v)
+	})
+}
+
+func (s *BoltStore) Update(key string, fn func(e *Entry, found bool) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(alertsBucket)
+		var e Entry
+		v := b.Get([]byte(key))
+		if v != nil {
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+		}
+		if err := fn(&e, v != nil); err != nil {
+			return err
+		}
+		if e.UpdatedAt.IsZero() {
+			e.UpdatedAt = time.Now()
+		}
+		v, err := json.Marshal(&e)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), v)
+	})
+}
+
+func (s *BoltStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(alertsBucket).Delete([]byte(key))
+	})
+}
+
+func (s *BoltStore) Cleanup(before time.Time) (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(alertsBucket)
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var e Entry
+			if err := json.Unmarshal(v, &e); err == nil && !e.UpdatedAt.Before(before) {
+				return nil
+			}
+			expired = append(expired, append([]byte(nil), k...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,75 @@
+package state
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps entries in process, it is used when state is not
+// persisted.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: map[string]Entry{}}
+}
+
+func (s *MemoryStore) Get(key string) (*Entry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	return &e, true, nil
+}
+
+func (s *MemoryStore) Put(key string, e *Entry) error {
+	if e.UpdatedAt.IsZero() {
+		e.UpdatedAt = time.Now()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = *e
+	return nil
+}
+
+func (s *MemoryStore) Update(key string, fn func(e *Entry, found bool) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, found := s.entries[key]
+	if err := fn(&e, found); err != nil {
+		return err
+	}
+	if e.UpdatedAt.IsZero() {
+		e.UpdatedAt = time.Now()
+	}
+	s.entries[key] = e
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemoryStore) Cleanup(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := 0
+	for k, e := range s.entries {
+		if e.UpdatedAt.Before(before) {
+			delete(s.entries, k)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,108 @@
+package state
+
+import (
+	"context"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/internal/alert"
+	"github.com/404LifeFound/alertmanager-lark/internal/health"
+	"github.com/rs/zerolog/log"
+	"go.uber.org/fx"
+)
+
+// Entry records the lark card that was posted for an alert.
+type Entry struct {
+	MessageID   string `json:"message_id"`
+	ChatID      string `json:"chat_id"`
+	GroupKey    string `json:"group_key"`
+	Fingerprint string `json:"fingerprint"`
+	Status      string `json:"status"`
+	// Acked stops re-notifications of the firing alert until it resolves.
+	Acked     bool                 `json:"acked"`
+	History   []alert.HistoryEntry `json:"history"`
+	UpdatedAt time.Time            `json:"updated_at"`
+	// Card is the alert card as it was last sent, card actions rebuild it
+	// from here. Its history is kept in History.
+	Card *alert.LarkCard `json:"card,omitempty"`
+}
+
+// Store keeps the fingerprint -> lark message mapping so that an alert
+// which re-fires or resolves updates its existing card.
+type Store interface {
+	Get(key string) (*Entry, bool, error)
+	Put(key string, e *Entry) error
+	// Update calls fn with the entry of key, a new one when found is false,
+	// and saves it unless fn fails. Workers and card actions update the same
+	// entries, Update keeps one from overwriting the other.
+	Update(key string, fn func(e *Entry, found bool) error) error
+	Delete(key string) error
+	// Cleanup removes entries which were not updated since before.
+	Cleanup(before time.Time) (int, error)
+	Close() error
+}
+
+func Key(chatID, groupKey, fingerprint string) string {
+	return chatID + "/" + groupKey + "/" + fingerprint
+}
+
+// NewStore returns the bolt store at state.path when state is enabled.
+// Otherwise the state is kept in memory, cards are then only updated in
+// place and acknowledgements only stop re-notifications until a restart.
+func NewStore(lc fx.Lifecycle, registry *health.Registry) (Store, error) {
+	cfg := config.GlobalConfig.State
+	var s Store
+	if cfg.Enabled {
+		bs, err := NewBoltStore(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		registry.Readiness("state_store", bs.Check)
+		s = bs
+	} else {
+		log.Warn().Msg("state is not enabled, card state is kept in memory and lost on restart")
+		s = NewMemoryStore()
+	}
+
+	ttl := time.Duration(cfg.TTLHours) * time.Hour
+	interval := time.Duration(cfg.CleanupIntervalMinutes) * time.Minute
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	cleanupCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+				if ttl <= 0 {
+					return
+				}
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-cleanupCtx.Done():
+						return
+					case <-ticker.C:
+						n, err := s.Cleanup(time.Now().Add(-ttl))
+						if err != nil {
+							log.Error().Err(err).Msg("failed to cleanup expired state entries")
+							continue
+						}
+						log.Info().Msgf("removed %d expired state entries", n)
+					}
+				}
+			}()
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			cancel()
+			<-done
+			return s.Close()
+		},
+	})
+
+	return s, nil
+}
@@ -0,0 +1,79 @@
+package state
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/404LifeFound/alertmanager-lark/internal/alert"
+)
+
+func stores(t *testing.T) map[string]Store {
+	bs, err := NewBoltStore(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bs.Close() })
+	return map[string]Store{"bolt": bs, "memory": NewMemoryStore()}
+}
+
+func TestUpdateKeepsAcknowledgement(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			key := Key("oc_1", "group", "fp")
+			if err := s.Put(key, &Entry{MessageID: "om_1", Status: alert.StatusFiring}); err != nil {
+				t.Fatal(err)
+			}
+
+			// a card action acknowledges the alert while the worker, which
+			// loaded the entry before, is sending the card
+			err := s.Update(key, func(e *Entry, found bool) error {
+				e.Acked = true
+				e.History = append(e.History, alert.NewHistoryEntry(alert.ActionAcknowledge, "ops", "ou_1"))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = s.Update(key, func(e *Entry, found bool) error {
+				if !found {
+					t.Error("entry not found")
+				}
+				e.MessageID = "om_1"
+				e.Status = alert.StatusFiring
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			e, found, err := s.Get(key)
+			if err != nil || !found {
+				t.Fatalf("get: found=%v err=%v", found, err)
+			}
+			if !e.Acked || len(e.History) != 1 {
+				t.Errorf("acknowledgement was lost: %+v", e)
+			}
+		})
+	}
+}
+
+func TestUpdateNewEntry(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			err := s.Update("k", func(e *Entry, found bool) error {
+				if found {
+					t.Error("unexpected entry")
+				}
+				e.MessageID = "om_1"
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			e, found, _ := s.Get("k")
+			if !found || e.MessageID != "om_1" || e.UpdatedAt.IsZero() {
+				t.Errorf("unexpected entry %+v", e)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/fx"
+)
+
+const (
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+
+	ProtocolHTTP = "http"
+	ProtocolGRPC = "grpc"
+)
+
+// Tracer starts the spans of the pipeline. Its spans are not recorded until
+// Setup installed an exporter, but trace context is still passed on.
+var Tracer = otel.Tracer("github.com/404LifeFound/alertmanager-lark")
+
+// Setup installs the w3c trace context propagator and the configured
+// exporter. Spans still buffered are flushed on stop.
+func Setup(lc fx.Lifecycle) error {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	tc := config.GlobalConfig.Tracing
+	if tc.Exporter == "" {
+		return nil
+	}
+	exporter, err := newExporter(tc)
+	if err != nil {
+		return err
+	}
+	service := tc.ServiceName
+	if service == "" {
+		service = "alertmanager-lark"
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", service)))
+	if err != nil {
+		return err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(tc.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	log.Info().Msgf("exporting traces to %s", tc.Exporter)
+
+	lc.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			return tp.Shutdown(ctx)
+		},
+	})
+	return nil
+}
+
+func newExporter(tc config.TracingConfig) (sdktrace.SpanExporter, error) {
+	ctx := context.Background()
+	switch tc.Exporter {
+	case ExporterStdout:
+		return stdouttrace.New()
+	case ExporterOTLP:
+		switch tc.Protocol {
+		case "", ProtocolHTTP:
+			opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(tc.Endpoint)}
+			if tc.Insecure {
+				opts = append(opts, otlptracehttp.WithInsecure())
+			}
+			return otlptracehttp.New(ctx, opts...)
+		case ProtocolGRPC:
+			opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(tc.Endpoint)}
+			if tc.Insecure {
+				opts = append(opts, otlptracegrpc.WithInsecure())
+			}
+			return otlptracegrpc.New(ctx, opts...)
+		default:
+			return nil, fmt.Errorf("invalid tracing protocol %s", tc.Protocol)
+		}
+	default:
+		return nil, fmt.Errorf("invalid tracing exporter %s", tc.Exporter)
+	}
+}
+
+// Inject returns the w3c trace context of the span in ctx.
+func Inject(ctx context.Context) (traceparent, tracestate string) {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier.Get("traceparent"), carrier.Get("tracestate")
+}
+
+// Extract returns ctx with the remote span of a w3c trace context as parent.
+func Extract(ctx context.Context, traceparent, tracestate string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier{
+		"traceparent": traceparent,
+		"tracestate":  tracestate,
+	})
+}
+
+// End ends span and marks it failed when err is set.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
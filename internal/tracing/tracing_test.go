@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/config/configtest"
+	"go.opentelemetry.io/otel"
+	"go.uber.org/fx/fxtest"
+)
+
+// collector is an otlp http collector stand-in keeping the exported
+// requests.
+type collector struct {
+	mu     sync.Mutex
+	bodies [][]byte
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	c.mu.Lock()
+	c.bodies = append(c.bodies, body)
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-protobuf")
+}
+
+// exported reports whether a span named name was exported.
+func (c *collector) exported(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, b := range c.bodies {
+		if bytes.Contains(b, []byte(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSetupExportsPropagatedSpans(t *testing.T) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+	savedProvider := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(savedProvider) })
+	configtest.Set(t).Tracing = config.TracingConfig{
+		Exporter:    ExporterOTLP,
+		Endpoint:    strings.TrimPrefix(srv.URL, "http://"),
+		Insecure:    true,
+		SampleRatio: 1,
+		ServiceName: "tracing-test",
+	}
+
+	lc := fxtest.NewLifecycle(t)
+	if err := Setup(lc); err != nil {
+		t.Fatal(err)
+	}
+	lc.RequireStart()
+
+	// the webhook span is continued by the worker from the queue headers
+	ctx, webhook := Tracer.Start(context.Background(), "webhook-span")
+	traceparent, tracestate := Inject(ctx)
+	webhook.End()
+	if traceparent == "" {
+		t.Fatal("no trace context was injected")
+	}
+	_, deliver := Tracer.Start(Extract(context.Background(), traceparent, tracestate), "deliver-span")
+	if got, want := deliver.SpanContext().TraceID(), webhook.SpanContext().TraceID(); got != want {
+		t.Errorf("delivery is traced in %s, want %s", got, want)
+	}
+	End(deliver, io.ErrUnexpectedEOF)
+
+	// stopping flushes the batched spans
+	lc.RequireStop()
+	for _, name := range []string{"webhook-span", "deliver-span", "tracing-test"} {
+		if !c.exported(name) {
+			t.Errorf("%s was not exported", name)
+		}
+	}
+}
+
+func TestSetupRejectsInvalidExporter(t *testing.T) {
+	cfg := configtest.Set(t)
+	for _, tc := range []config.TracingConfig{
+		{Exporter: "zipkin"},
+		{Exporter: ExporterOTLP, Protocol: "udp"},
+	} {
+		cfg.Tracing = tc
+		if err := Setup(fxtest.NewLifecycle(t)); err == nil {
+			t.Errorf("tracing %+v was accepted", tc)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/internal/alert"
+	"github.com/404LifeFound/alertmanager-lark/internal/metrics"
+	"github.com/404LifeFound/alertmanager-lark/internal/mq"
+	"github.com/404LifeFound/alertmanager-lark/internal/route"
+	"github.com/404LifeFound/alertmanager-lark/internal/state"
+	"github.com/404LifeFound/alertmanager-lark/internal/tracing"
+	"github.com/go-lark/lark"
+	"github.com/prometheus/alertmanager/notify/webhook"
+	"github.com/prometheus/alertmanager/template"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Delivery renders the alerts of a webhook message as lark cards and sends
+// them to the routed chats.
+type Delivery struct {
+	Bot       *lark.Bot
+	Store     state.Store
+	Tree      *route.Route
+	Receivers route.Receivers
+	Templates *alert.Templates
+}
+
+// DeliveryError is the failure of a message at a stage, deliveries are
+// reported per card by the chat and state key of the card.
+type DeliveryError struct {
+	Stage  string
+	ChatID string
+	Key    string
+	Err    error
+}
+
+func (e *DeliveryError) Error() string {
+	if e.ChatID != "" {
+		return fmt.Sprintf("%s to chat %s: %v", e.Stage, e.ChatID, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Stage, e.Err)
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent reports whether handling the message again can't succeed, the
+// message is broken or lark refuses the chat for good.
+func (e *DeliveryError) Permanent() bool {
+	return e.Stage == mq.StageDecode || alert.IsPermanent(e.Err)
+}
+
+// DeliveryErrors flattens the errors returned by Handle.
+func DeliveryErrors(err error) []*DeliveryError {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var out []*DeliveryError
+		for _, e := range joined.Unwrap() {
+			out = append(out, DeliveryErrors(e)...)
+		}
+		return out
+	}
+	var de *DeliveryError
+	if errors.As(err, &de) {
+		return []*DeliveryError{de}
+	}
+	if err != nil {
+		return []*DeliveryError{{Stage: mq.StageDeliver, Err: err}}
+	}
+	return nil
+}
+
+// scope limits a delivery attempt to some of the cards of a message.
+type scope struct {
+	// target is the only chat of a replayed dead letter
+	target string
+	// keys are the state keys of the cards left to deliver, nil delivers
+	// every card
+	keys map[string]bool
+}
+
+func (s scope) has(key string) bool {
+	return s.keys == nil || s.keys[key]
+}
+
+// Handle delivers every alert of the message. It returns the DeliveryErrors
+// of the cards that could not be sent, in which case the message must be
+// handled again with them as retry; only their cards are sent again then.
+func (d *Delivery) Handle(ctx context.Context, m mq.Message, retry ...*DeliveryError) error {
+	envelope, err := mq.OpenEnvelope(m)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to open envelope %v", string(m.Value))
+		return &DeliveryError{Stage: mq.StageDecode, Err: err}
+	}
+	var webhook_event webhook.Message
+	if err := json.Unmarshal(envelope.Payload, &webhook_event); err != nil {
+		log.Error().Err(err).Msgf("failed to unmarshal %v", string(envelope.Payload))
+		return &DeliveryError{Stage: mq.StageDecode, Err: err}
+	}
+	if webhook_event.Data == nil {
+		log.Warn().Msgf("no alerts in message at %s", m.Position())
+		return nil
+	}
+	if envelope.Version > 0 {
+		log.Debug().Msgf("message at %s was received at %s from %s, request id: %s", m.Position(), envelope.ReceivedAt, envelope.SourceIP, envelope.RequestID)
+	}
+
+	receiver, has_receiver := d.Receivers.Lookup(envelope.Route, webhook_event.Receiver)
+	if !has_receiver {
+		receiver = &route.Receiver{}
+	}
+
+	mode := config.GlobalConfig.Card.Mode
+	if receiver.Mode != "" {
+		mode = receiver.Mode
+	}
+	// replayed dead letters are only delivered to the chat that failed
+	s := scope{target: mq.HeaderValue(m, mq.HeaderChatID)}
+	for _, f := range retry {
+		if f.Key == "" {
+			// the failure isn't tied to a card, everything is sent again
+			s.keys = nil
+			break
+		}
+		if s.keys == nil {
+			s.keys = map[string]bool{}
+		}
+		s.keys[f.Key] = true
+	}
+	if mode == alert.ModeGrouped {
+		return d.handleGroup(ctx, &webhook_event, receiver, s)
+	}
+	var errs []error
+	for _, a := range webhook_event.Alerts {
+		if err := d.handleAlert(ctx, &webhook_event, receiver, s, a); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (d *Delivery) chatIDs(receiver *route.Receiver, s scope, a template.Alert) []string {
+	if s.target != "" {
+		return []string{s.target}
+	}
+	if len(receiver.ChatIDs) > 0 {
+		return receiver.ChatIDs
+	}
+	return d.Tree.MatchChatIDs(a.Labels)
+}
+
+// templateName picks the card template requested by the alert, falling back
+// to the one of the receiver.
+func (d *Delivery) templateName(receiver *route.Receiver, a template.Alert) string {
+	name := FindFirstValue(a, "", config.GlobalConfig.AlertFields.TemplateKeys...)
+	if name != "" && !d.Templates.Has(name) {
+		log.Warn().Msgf("alert %s asks for undefined card template %s", a.Fingerprint, name)
+		name = ""
+	}
+	if name == "" {
+		name = receiver.Template
+	}
+	return name
+}
+
+func (d *Delivery) handleAlert(ctx context.Context, webhook_event *webhook.Message, receiver *route.Receiver, s scope, a template.Alert) error {
+	alertname := FindFirstValue(a, "N/A", config.GlobalConfig.AlertFields.AlertNameKeys...)
+	project := FindFirstValue(a, "N/A", config.GlobalConfig.AlertFields.ProjectKeys...)
+	notify_emails := FindFirstValue(a, "", config.GlobalConfig.AlertFields.NotifyEmailsKeys...)
+	grafana_url := FindFirstValue(a, "N/A", config.GlobalConfig.AlertFields.GrafanaURLKeys...)
+	runbook_url := FindFirstValue(a, "N/A", config.GlobalConfig.AlertFields.RunBookURLKeys...)
+	description := FindFirstValue(a, "N/A", config.GlobalConfig.AlertFields.DescriptionKeys...)
+
+	status := a.Status
+	if status == "" {
+		status = webhook_event.Status
+	}
+
+	c := &alert.LarkCard{
+		Title:        alertname,
+		Status:       status,
+		Fingerprint:  a.Fingerprint,
+		Labels:       a.Labels,
+		Project:      project,
+		Time:         a.StartsAt.Format(time.RFC3339Nano),
+		AssignEmails: strings.Split(notify_emails, ","),
+		Mention:      receiver.Mention,
+		GrafanaURL:   grafana_url,
+		RunBookURL:   runbook_url,
+		Metric:       a.GeneratorURL,
+		Description:  description,
+		GroupKey:     webhook_event.GroupKey,
+	}
+	if c.IsResolved() && !a.EndsAt.IsZero() {
+		c.WithEndsAt(a.EndsAt.Format(time.RFC3339Nano))
+	}
+
+	template_name := d.templateName(receiver, a)
+	chatIDs := d.chatIDs(receiver, s, a)
+	if len(chatIDs) == 0 {
+		log.Warn().Msgf("no chat routed for alert %s, labels: %v", a.Fingerprint, a.Labels)
+	}
+	var errs []error
+	for _, chatID := range chatIDs {
+		key := state.Key(chatID, webhook_event.GroupKey, a.Fingerprint)
+		if !s.has(key) {
+			continue
+		}
+		prev := d.load(key)
+		if prev != nil && prev.Acked && !c.IsResolved() {
+			log.Info().Msgf("alert %s is acknowledged in chat %s, skip re-notification", a.Fingerprint, chatID)
+			continue
+		}
+
+		// every chat renders its own copy, the card carries the history of
+		// the actions taken in that chat
+		chat_card := *c
+		if prev != nil {
+			chat_card.History = prev.History
+			if prev.Card != nil {
+				chat_card.SilenceID = prev.Card.SilenceID
+				chat_card.SilencedUntil = prev.Card.SilencedUntil
+			}
+		}
+		// rendering formats the card in place, the state keeps it as is
+		snapshot := chat_card
+		snapshot.History = nil
+		card_s, err := d.render(ctx, template_name, chatID, &alert.CardData{
+			Data:            webhook_event.Data,
+			GroupKey:        webhook_event.GroupKey,
+			TruncatedAlerts: webhook_event.TruncatedAlerts,
+			Alert:           a,
+			Card:            &chat_card,
+		})
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to render card template %s, using the default card", template_name)
+			card_s = chat_card.Card()
+		}
+		log.Info().Msgf("card string is: %s", card_s)
+
+		if err := d.deliver(ctx, key, prev, &state.Entry{
+			ChatID:      chatID,
+			GroupKey:    webhook_event.GroupKey,
+			Fingerprint: a.Fingerprint,
+			Status:      status,
+			Card:        &snapshot,
+		}, card_s); err != nil {
+			log.Error().Err(err).Msgf("faild to send card message of alert %s to chat: %v", a.Fingerprint, chatID)
+			errs = append(errs, &DeliveryError{Stage: mq.StageDeliver, ChatID: chatID, Key: key, Err: fmt.Errorf("alert %s: %w", a.Fingerprint, err)})
+			continue
+		}
+		observeLatency(a)
+	}
+	return errors.Join(errs...)
+}
+
+// handleGroup posts one card per chat for the whole notification group.
+func (d *Delivery) handleGroup(ctx context.Context, webhook_event *webhook.Message, receiver *route.Receiver, s scope) error {
+	var chatOrder []string
+	chatAlerts := map[string]template.Alerts{}
+	for _, a := range webhook_event.Alerts {
+		chatIDs := d.chatIDs(receiver, s, a)
+		if len(chatIDs) == 0 {
+			log.Warn().Msgf("no chat routed for alert %s, labels: %v", a.Fingerprint, a.Labels)
+		}
+		for _, chatID := range chatIDs {
+			if _, ok := chatAlerts[chatID]; !ok {
+				chatOrder = append(chatOrder, chatID)
+			}
+			chatAlerts[chatID] = append(chatAlerts[chatID], a)
+		}
+	}
+
+	title := webhook_event.GroupLabels["alertname"]
+	if title == "" {
+		title = webhook_event.CommonLabels["alertname"]
+	}
+	if title == "" {
+		title = webhook_event.Receiver
+	}
+
+	template_name := receiver.Template
+	if len(webhook_event.Alerts) > 0 {
+		template_name = d.templateName(receiver, template.Alert{
+			Labels:      webhook_event.CommonLabels,
+			Annotations: webhook_event.CommonAnnotations,
+			Fingerprint: webhook_event.GroupKey,
+		})
+	}
+
+	var errs []error
+	for _, chatID := range chatOrder {
+		key := state.Key(chatID, webhook_event.GroupKey, "")
+		if !s.has(key) {
+			continue
+		}
+		alerts := chatAlerts[chatID]
+		var emails []string
+		for _, a := range alerts {
+			if e := FindFirstValue(a, "", config.GlobalConfig.AlertFields.NotifyEmailsKeys...); e != "" {
+				emails = append(emails, strings.Split(e, ",")...)
+			}
+		}
+		g := &alert.GroupCard{
+			Title:             title,
+			GroupLabels:       webhook_event.GroupLabels,
+			CommonLabels:      webhook_event.CommonLabels,
+			CommonAnnotations: webhook_event.CommonAnnotations,
+			Alerts:            alerts,
+			TruncatedAlerts:   webhook_event.TruncatedAlerts,
+			ExternalURL:       webhook_event.ExternalURL,
+			AssignEmails:      dedup(emails),
+			Mention:           receiver.Mention,
+			MaxRows:           config.GlobalConfig.Card.GroupedMaxAlerts,
+		}
+		card_s, err := d.render(ctx, template_name, chatID, &alert.CardData{
+			Data:            webhook_event.Data,
+			GroupKey:        webhook_event.GroupKey,
+			TruncatedAlerts: webhook_event.TruncatedAlerts,
+			Group:           g,
+		})
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to render card template %s, using the default card", template_name)
+			card_s = g.Card()
+		}
+		log.Info().Msgf("card string is: %s", card_s)
+
+		if err := d.deliver(ctx, key, d.load(key), &state.Entry{
+			ChatID:   chatID,
+			GroupKey: webhook_event.GroupKey,
+			Status:   webhook_event.Status,
+		}, card_s); err != nil {
+			log.Error().Err(err).Msgf("faild to send card message of group %s to chat: %v", webhook_event.GroupKey, chatID)
+			errs = append(errs, &DeliveryError{Stage: mq.StageDeliver, ChatID: chatID, Key: key, Err: fmt.Errorf("group %s: %w", webhook_event.GroupKey, err)})
+			continue
+		}
+		observeLatency(alerts...)
+	}
+	return errors.Join(errs...)
+}
+
+// render renders the card of chatID with the template name.
+func (d *Delivery) render(ctx context.Context, name string, chatID string, data *alert.CardData) (string, error) {
+	_, span := tracing.Tracer.Start(ctx, "render card", trace.WithAttributes(
+		attribute.String("template", name),
+		attribute.String("chat_id", chatID),
+	))
+	card, err := d.Templates.Render(name, data)
+	tracing.End(span, err)
+	return card, err
+}
+
+// observeLatency records how long after they started, or resolved, the
+// cards of alerts were delivered.
+func observeLatency(alerts ...template.Alert) {
+	now := time.Now()
+	for _, a := range alerts {
+		since := a.StartsAt
+		if a.Status == alert.StatusResolved {
+			since = a.EndsAt
+		}
+		if since.IsZero() {
+			continue
+		}
+		metrics.AlertDeliveryLatency.WithLabelValues(a.Status).Observe(now.Sub(since).Seconds())
+	}
+}
+
+func (d *Delivery) load(key string) *state.Entry {
+	prev, found, err := d.Store.Get(key)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to load state of %s", key)
+	}
+	if !found {
+		return nil
+	}
+	return prev
+}
+
+// deliver updates the card previously posted for key in place, or posts a
+// new card and remembers its message id when there is none. A new card is
+// only posted instead of an update when the update fails permanently, as
+// when the message was deleted; other errors are returned so the update is
+// retried rather than the chat getting a duplicate card.
+func (d *Delivery) deliver(ctx context.Context, key string, prev *state.Entry, entry *state.Entry, card string) error {
+	messageID := ""
+	if prev != nil && prev.MessageID != "" {
+		err := alert.UpdateCard(ctx, d.Bot, prev.MessageID, card)
+		switch {
+		case err == nil:
+			messageID = prev.MessageID
+		case alert.IsPermanent(err):
+			log.Warn().Err(err).Msgf("failed to update message %s, posting a new card", prev.MessageID)
+		default:
+			return err
+		}
+	}
+	if messageID == "" {
+		var err error
+		if messageID, err = alert.PostCard(ctx, d.Bot, entry.ChatID, card); err != nil {
+			return err
+		}
+	}
+
+	// card actions may have changed the entry since it was loaded, their
+	// acknowledgement and history are kept
+	err := d.Store.Update(key, func(e *state.Entry, found bool) error {
+		acked := found && e.Acked
+		history := e.History
+		*e = *entry
+		e.MessageID = messageID
+		e.History = history
+		// a resolved alert starts over when it fires again
+		e.Acked = acked && entry.Status != alert.StatusResolved
+		e.UpdatedAt = time.Now()
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to save state of %s", key)
+	}
+	return nil
+}
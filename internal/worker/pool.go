@@ -0,0 +1,191 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/internal/mq"
+	"github.com/rs/zerolog/log"
+)
+
+// pool delivers messages on a fixed number of lanes. Messages are hashed to
+// a lane by their notification group, so the cards of a group are sent in
+// order while a slow group doesn't hold up the others.
+type pool struct {
+	consumer mq.Consumer
+	dlq      *mq.DLQ
+	delivery *Delivery
+	lanes    []chan mq.Message
+	slots    chan struct{}
+	// busy holds when each lane started its current delivery attempt as
+	// unix nanoseconds, 0 while the lane waits for messages
+	busy []atomic.Int64
+	// pending counts the messages fetched and not committed yet
+	pending atomic.Int64
+	// done is closed once run returned
+	done chan struct{}
+}
+
+func newPool(consumer mq.Consumer, dlq *mq.DLQ, delivery *Delivery) *pool {
+	workers := config.GlobalConfig.Delivery.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	max_in_flight := config.GlobalConfig.Delivery.MaxInFlight
+	if max_in_flight < workers {
+		max_in_flight = workers
+	}
+	p := &pool{
+		consumer: consumer,
+		dlq:      dlq,
+		delivery: delivery,
+		lanes:    make([]chan mq.Message, workers),
+		slots:    make(chan struct{}, max_in_flight),
+		busy:     make([]atomic.Int64, workers),
+		done:     make(chan struct{}),
+	}
+	for i := range p.lanes {
+		p.lanes[i] = make(chan mq.Message, max_in_flight)
+	}
+	return p
+}
+
+// run fetches messages until fetchCtx is cancelled and delivers them until
+// deliverCtx is cancelled. It returns once the lanes delivered every message
+// that was fetched, or gave up on them.
+func (p *pool) run(fetchCtx, deliverCtx context.Context) {
+	defer close(p.done)
+	var wg sync.WaitGroup
+	for i := range p.lanes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.work(deliverCtx, i)
+		}()
+	}
+
+	p.fetch(fetchCtx)
+	// fetch is the only sender, the lanes exit once they are drained
+	for _, lane := range p.lanes {
+		close(lane)
+	}
+	wg.Wait()
+}
+
+// inflight is the number of messages fetched and not committed yet.
+func (p *pool) inflight() int64 {
+	return p.pending.Load()
+}
+
+// fetch hands fetched messages to their lanes, it blocks while the max
+// number of messages are in flight.
+func (p *pool) fetch(ctx context.Context) {
+	backoff := time.Second
+	for {
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			log.Info().Msg("worker context cancelled, exiting consumer")
+			return
+		}
+		m, err := p.consumer.Fetch(ctx)
+		if err != nil {
+			<-p.slots
+			if ctx.Err() != nil {
+				// lifecycle cancelled
+				log.Info().Msg("worker context cancelled, exiting consumer")
+				return
+			}
+			log.Error().Err(err).Msg("fetch message failed, will retry")
+			if !sleep(ctx, backoff) {
+				return
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		// reset backoff on success
+		backoff = time.Second
+
+		p.pending.Add(1)
+		select {
+		case p.lanes[p.lane(m)] <- m:
+		case <-ctx.Done():
+			p.pending.Add(-1)
+			return
+		}
+	}
+}
+
+func (p *pool) work(ctx context.Context, i int) {
+	busy := &p.busy[i]
+	beat := func() {
+		busy.Store(time.Now().UnixNano())
+	}
+	for m := range p.lanes[i] {
+		// once delivery is aborted the rest of the lane is left uncommitted
+		// and consumed again after the restart
+		if ctx.Err() == nil && process(ctx, p.dlq, p.delivery, m, beat) {
+			beat()
+			if err := p.consumer.Commit(ctx, m); err != nil {
+				// the message is delivered again, cards already sent are
+				// updated in place
+				log.Error().Err(err).Msgf("failed to commit message at %s", m.Position())
+			}
+		}
+		busy.Store(0)
+		p.pending.Add(-1)
+		<-p.slots
+	}
+}
+
+// alive fails when a lane spent more than stuck on one delivery attempt or
+// commit, a hung call would otherwise hold up its lane forever.
+func (p *pool) alive(stuck time.Duration) error {
+	now := time.Now()
+	for i := range p.busy {
+		since := p.busy[i].Load()
+		if since == 0 {
+			continue
+		}
+		if d := now.Sub(time.Unix(0, since)); d > stuck {
+			return fmt.Errorf("worker %d is stuck on a message for %s", i, d.Truncate(time.Second))
+		}
+	}
+	return nil
+}
+
+func (p *pool) lane(m mq.Message) int {
+	h := fnv.New32a()
+	h.Write([]byte(laneKey(m)))
+	return int(h.Sum32() % uint32(len(p.lanes)))
+}
+
+// laneKey is the alert of a fanned out record or the notification group of
+// m, falling back to its key and partition.
+func laneKey(m mq.Message) string {
+	if fp := mq.HeaderValue(m, mq.HeaderFingerprint); fp != "" {
+		return fp
+	}
+	if group_key := mq.HeaderValue(m, mq.HeaderGroupKey); group_key != "" {
+		return group_key
+	}
+	var group struct {
+		GroupKey string `json:"groupKey"`
+	}
+	if envelope, err := mq.OpenEnvelope(m); err == nil {
+		if err := json.Unmarshal(envelope.Payload, &group); err == nil && group.GroupKey != "" {
+			return group.GroupKey
+		}
+	}
+	if len(m.Key) > 0 {
+		return string(m.Key)
+	}
+	return strconv.Itoa(m.Partition)
+}
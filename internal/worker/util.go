@@ -1,6 +1,10 @@
 package worker
 
-import "github.com/prometheus/alertmanager/template"
+import (
+	"strings"
+
+	"github.com/prometheus/alertmanager/template"
+)
 
 func FindFirstValue(alert template.Alert, defaultValue string, keys ...string) string {
 	for _, key := range keys {
@@ -13,3 +17,17 @@ func FindFirstValue(alert template.Alert, defaultValue string, keys ...string) s
 	}
 	return defaultValue
 }
+
+func dedup(values []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" || seen[v] {
+			continue
+		}
+		seen[v] = true
+		out = append(out, v)
+	}
+	return out
+}
@@ -2,109 +2,212 @@ package worker
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"strings"
+	"errors"
+	"slices"
 	"time"
 
 	"github.com/404LifeFound/alertmanager-lark/config"
 	"github.com/404LifeFound/alertmanager-lark/internal/alert"
+	"github.com/404LifeFound/alertmanager-lark/internal/health"
+	"github.com/404LifeFound/alertmanager-lark/internal/metrics"
+	"github.com/404LifeFound/alertmanager-lark/internal/mq"
+	"github.com/404LifeFound/alertmanager-lark/internal/route"
+	"github.com/404LifeFound/alertmanager-lark/internal/state"
+	"github.com/404LifeFound/alertmanager-lark/internal/tracing"
 	"github.com/go-lark/lark"
-	"github.com/prometheus/alertmanager/notify/webhook"
 	"github.com/rs/zerolog/log"
-	kafka "github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/fx"
 )
 
-func Run(lc fx.Lifecycle, reader *kafka.Reader, bot *lark.Bot) {
-	workerCtx, cancel := context.WithCancel(context.Background())
+func Run(lc fx.Lifecycle, consumer mq.Consumer, dlq *mq.DLQ, bot *lark.Bot, store state.Store, tree *route.Route, receivers route.Receivers, templates *alert.Templates, registry *health.Registry) {
+	delivery := &Delivery{
+		Bot:       bot,
+		Store:     store,
+		Tree:      tree,
+		Receivers: receivers,
+		Templates: templates,
+	}
+	p := newPool(consumer, dlq, delivery)
+	stuck := time.Duration(config.GlobalConfig.Health.StuckSeconds) * time.Second
+	if stuck <= 0 {
+		stuck = 5 * time.Minute
+	}
+	registry.Liveness("consumer", func(context.Context) error {
+		return p.alive(stuck)
+	})
+	// stopping cancels fetching first and lets the messages in flight finish,
+	// their delivery is only aborted when the stop timeout runs out
+	fetchCtx, stopFetch := context.WithCancel(context.Background())
+	deliverCtx, abort := context.WithCancel(context.Background())
 	lc.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
-			go func() {
-				backoff := time.Second
-				for {
-					m, err := reader.ReadMessage(workerCtx)
-					if err != nil {
-						if workerCtx.Err() != nil {
-							// lifecycle cancelled
-							log.Info().Msg("worker context cancelled, exiting kafka consumer")
-							break
-						}
-						log.Error().Err(err).Msg("read message failed, will retry")
-						time.Sleep(backoff)
-						if backoff < 30*time.Second {
-							backoff *= 2
-						}
-						continue
-					}
-					// reset backoff on success
-					backoff = time.Second
-					log.Info().Msgf("message at offset %d: %s = %s\n", m.Offset, string(m.Key), string(m.Value))
-
-					var webhook_event webhook.Message
-					if err = json.Unmarshal(m.Value, &webhook_event); err != nil {
-						log.Error().Err(err).Msgf("failed to unmarshal %v", string(m.Value))
-					}
-
-					for _, a := range webhook_event.Alerts {
-						alertname := FindFirstValue(a, "N/A", config.GlobalConfig.AlertFields.AlertNameKeys...)
-						project := FindFirstValue(a, "N/A", config.GlobalConfig.AlertFields.ProjectKeys...)
-						notify_emails := FindFirstValue(a, "", config.GlobalConfig.AlertFields.NotifyEmailsKeys...)
-						grafana_url := FindFirstValue(a, "N/A", config.GlobalConfig.AlertFields.GrafanaURLKeys...)
-						runbook_url := FindFirstValue(a, "N/A", config.GlobalConfig.AlertFields.RunBookURLKeys...)
-						description := FindFirstValue(a, "N/A", config.GlobalConfig.AlertFields.DescriptionKeys...)
-
-						c := &alert.LarkCard{
-							Title:        alertname,
-							Project:      project,
-							Time:         a.StartsAt.Format(time.RFC3339Nano),
-							AssignEmails: strings.Split(notify_emails, ","),
-							GrafanaURL:   grafana_url,
-							RunBookURL:   runbook_url,
-							Metric:       a.GeneratorURL,
-							Description:  description,
-						}
-						card_s := c.NewLarkCard()
-						log.Info().Msgf("card string is: %s", card_s)
-						retries := config.GlobalConfig.Lark.SendRetries
-						if retries <= 0 {
-							retries = 1
-						}
-						backoff := time.Duration(config.GlobalConfig.Lark.SendRetryBackoff) * time.Millisecond
-						var sendErr error
-						var resp *lark.PostMessageResponse
-						for attempt := 1; attempt <= retries; attempt++ {
-							resp, sendErr = bot.PostMessage(
-								lark.NewMsgBuffer(lark.MsgInteractive).
-									BindChatID(config.GlobalConfig.Lark.ChatID).
-									Card(card_s).
-									Build(),
-							)
-							if sendErr == nil {
-								if resp.Code != 0 {
-									sendErr = fmt.Errorf("lark api error: code=%d, msg=%s", resp.Code, resp.Msg)
-								} else {
-									break
-								}
-							}
-							if attempt < retries {
-								time.Sleep(backoff)
-							}
-						}
-						if sendErr != nil {
-							log.Error().Err(sendErr).Msgf("faild to send card message %v to chat: %v", string(m.Value), config.GlobalConfig.Lark.ChatID)
-						}
-
-					}
-
-				}
-			}()
+			go p.run(fetchCtx, deliverCtx)
+			if lr, ok := consumer.(mq.LagReporter); ok {
+				go reportLag(fetchCtx, lr)
+			}
 			return nil
 		},
 		OnStop: func(ctx context.Context) error {
-			log.Info().Msg("stopping kafka consumer")
-			cancel()
-			return nil
+			log.Info().Msgf("stopping consumer, waiting for %d messages in flight", p.inflight())
+			stopFetch()
+			select {
+			case <-p.done:
+				log.Info().Msg("messages in flight were delivered")
+				return nil
+			case <-ctx.Done():
+				abort()
+				log.Warn().Msgf("stop timed out, %d messages in flight are left uncommitted", p.inflight())
+				return ctx.Err()
+			}
 		},
 	})
 }
+
+// process handles m until every card of it was delivered, dead-lettered or
+// dropped, beat is called before every attempt. Cards lark refuses for good
+// are given up at once, the others after kafka.maxDeliveryAttempts. It
+// reports false when ctx is cancelled first, the message must then be left
+// uncommitted.
+func process(ctx context.Context, dlq *mq.DLQ, delivery *Delivery, m mq.Message, beat func()) bool {
+	log.Info().Msgf("message at %s: %s = %s\n", m.Position(), string(m.Key), string(m.Value))
+	// the span continues the trace of the webhook the message was written by
+	ctx, span := tracing.Tracer.Start(
+		tracing.Extract(ctx, mq.HeaderValue(m, mq.HeaderTraceParent), mq.HeaderValue(m, mq.HeaderTraceState)),
+		"process message", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("position", m.Position())))
+	defer span.End()
+	start := time.Now()
+	observe := func(result string) {
+		span.SetAttributes(attribute.String("result", result))
+		metrics.MessageProcessingDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}
+	backoff := time.Second
+	var failures []*DeliveryError
+	for attempt := 1; ; attempt++ {
+		beat()
+		err := handle(ctx, delivery, m, attempt, failures)
+		if err == nil {
+			observe("delivered")
+			return true
+		}
+		failures = DeliveryErrors(err)
+		max_attempts := config.GlobalConfig.Kafka.MaxDeliveryAttempts
+		give_up := failures
+		if max_attempts <= 0 || attempt < max_attempts {
+			give_up = slices.DeleteFunc(slices.Clone(failures), func(f *DeliveryError) bool {
+				return !f.Permanent()
+			})
+		}
+		if len(give_up) > 0 {
+			if result, ok := discard(ctx, dlq, m, give_up, attempt); ok {
+				failures = slices.DeleteFunc(failures, func(f *DeliveryError) bool {
+					return slices.Contains(give_up, f)
+				})
+				if len(failures) == 0 {
+					observe(result)
+					return true
+				}
+			}
+		}
+		log.Error().Err(err).Msgf("delivery of message at %s failed (attempt %d), will retry %d cards", m.Position(), attempt, len(failures))
+		if !sleep(ctx, backoff) {
+			log.Info().Msgf("worker context cancelled, message at %s is left uncommitted", m.Position())
+			observe("cancelled")
+			return false
+		}
+		backoff = nextBackoff(backoff)
+	}
+}
+
+// handle makes one delivery attempt of m, retry are the failures of the
+// previous attempt.
+func handle(ctx context.Context, delivery *Delivery, m mq.Message, attempt int, retry []*DeliveryError) error {
+	ctx, span := tracing.Tracer.Start(ctx, "deliver", trace.WithAttributes(attribute.Int("attempt", attempt)))
+	err := delivery.Handle(ctx, m, retry...)
+	tracing.End(span, err)
+	return err
+}
+
+// discard gives up on the failures of m, they are dead-lettered or dropped
+// when there is no dead letter topic. It reports false when dead-lettering
+// failed and the failures must be retried.
+func discard(ctx context.Context, dlq *mq.DLQ, m mq.Message, failures []*DeliveryError, attempts int) (string, bool) {
+	if !dlq.Enabled() {
+		for _, f := range failures {
+			log.Error().Err(f).Msgf("dropping undeliverable message at %s after %d attempts", m.Position(), attempts)
+		}
+		return "dropped", true
+	}
+	if err := deadLetter(ctx, dlq, m, failures, attempts); err != nil {
+		log.Error().Err(err).Msgf("failed to dead-letter message at %s", m.Position())
+		return "", false
+	}
+	return "dead_lettered", true
+}
+
+// reportLag updates the consumer lag gauge until ctx is cancelled.
+func reportLag(ctx context.Context, lr mq.LagReporter) {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for {
+		lag, err := lr.Lag(ctx)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to get consumer lag")
+		} else {
+			metrics.ConsumerLag.Set(float64(lag))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deadLetter publishes m once per failed chat, or once when the message
+// itself is broken.
+func deadLetter(ctx context.Context, dlq *mq.DLQ, m mq.Message, failures []*DeliveryError, attempts int) error {
+	var letters []mq.DeadLetter
+	index := map[string]int{}
+	for _, f := range failures {
+		if i, ok := index[f.ChatID]; ok {
+			letters[i].Err = errors.Join(letters[i].Err, f.Err)
+			continue
+		}
+		index[f.ChatID] = len(letters)
+		letters = append(letters, mq.DeadLetter{
+			Stage:    f.Stage,
+			ChatID:   f.ChatID,
+			Attempts: attempts,
+			Err:      f.Err,
+		})
+	}
+	if err := dlq.Publish(ctx, m, letters...); err != nil {
+		return err
+	}
+	for _, l := range letters {
+		log.Warn().Err(l.Err).Msgf("dead-lettered message at %s, stage: %s, chat: %s", m.Position(), l.Stage, l.ChatID)
+	}
+	return nil
+}
+
+// sleep waits for d and reports false when ctx is cancelled first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func nextBackoff(d time.Duration) time.Duration {
+	if d < 30*time.Second {
+		d *= 2
+	}
+	return d
+}
@@ -0,0 +1,367 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/404LifeFound/alertmanager-lark/config"
+	"github.com/404LifeFound/alertmanager-lark/config/configtest"
+	"github.com/404LifeFound/alertmanager-lark/internal/alert"
+	"github.com/404LifeFound/alertmanager-lark/internal/health"
+	"github.com/404LifeFound/alertmanager-lark/internal/mq"
+	"github.com/404LifeFound/alertmanager-lark/internal/route"
+	"github.com/404LifeFound/alertmanager-lark/internal/state"
+	"github.com/go-lark/lark"
+	"github.com/prometheus/alertmanager/notify/webhook"
+	"github.com/prometheus/alertmanager/template"
+	"go.uber.org/fx/fxtest"
+)
+
+// larkStandIn answers the message api calls of the bot it returns, code
+// gives the lark error code of each call by chat id. Messages are created
+// with the id om_<chat id>, updates are counted for that chat.
+type larkStandIn struct {
+	mu    sync.Mutex
+	code  func(chatID string) int
+	calls []string
+	// called receives the chat id of every call
+	called chan string
+}
+
+func newLarkStandIn(t *testing.T, code func(chatID string) int) (*larkStandIn, *lark.Bot) {
+	t.Helper()
+	s := &larkStandIn{code: code, called: make(chan string, 100)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ReceiveID string `json:"receive_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		chatID := body.ReceiveID
+		if r.Method != http.MethodPost {
+			chatID = strings.TrimPrefix(path.Base(r.URL.Path), "om_")
+		}
+		s.mu.Lock()
+		s.calls = append(s.calls, chatID)
+		s.mu.Unlock()
+		s.called <- chatID
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"code": %d, "msg": "stand-in", "data": {"message_id": "om_%s"}}`, s.code(chatID), chatID)
+	}))
+	t.Cleanup(srv.Close)
+	bot := lark.NewChatBot("app", "secret")
+	bot.SetDomain(srv.URL)
+	return s, bot
+}
+
+// Calls returns the chat ids sent to so far.
+func (s *larkStandIn) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+// setConfig sends to lark without retries, unless a test asks for them.
+func setConfig(t *testing.T) *config.Config {
+	t.Helper()
+	cfg := configtest.Set(t)
+	cfg.Lark.SendRetries = 1
+	return cfg
+}
+
+func newTestDelivery(bot *lark.Bot, chatIDs ...string) *Delivery {
+	return &Delivery{
+		Bot:   bot,
+		Store: state.NewMemoryStore(),
+		Receivers: route.Receivers{
+			"team": {Name: "team", ChatIDs: chatIDs},
+		},
+		Templates: &alert.Templates{},
+	}
+}
+
+// alertMessage is the queue message of a notification of the team receiver
+// with one firing alert.
+func alertMessage(t *testing.T) mq.Message {
+	t.Helper()
+	a := template.Alert{
+		Status:      alert.StatusFiring,
+		Labels:      template.KV{"alertname": "DiskFull"},
+		StartsAt:    time.Now(),
+		Fingerprint: "fp1",
+	}
+	payload, err := json.Marshal(&webhook.Message{
+		Data: &template.Data{
+			Receiver: "team",
+			Status:   alert.StatusFiring,
+			Alerts:   template.Alerts{a},
+		},
+		Version:  "4",
+		GroupKey: "{}:{alertname=\"DiskFull\"}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &mq.Envelope{Version: mq.EnvelopeVersion, ReceivedAt: time.Now(), Route: "team", Payload: payload}
+	value, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mq.Message{Key: []byte("fp1"), Value: value, Headers: e.Headers(), Topic: "test"}
+}
+
+// recordingQueue is a memory queue remembering the committed messages.
+type recordingQueue struct {
+	*mq.MemoryQueue
+	mu        sync.Mutex
+	committed []mq.Message
+}
+
+func (q *recordingQueue) Commit(ctx context.Context, m mq.Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.committed = append(q.committed, m)
+	return nil
+}
+
+func (q *recordingQueue) Committed() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.committed)
+}
+
+func TestAbortStopsDeliveryInFlight(t *testing.T) {
+	cfg := setConfig(t)
+	cfg.Lark.SendRetries = 5
+	cfg.Lark.SendRetryBackoff = int(time.Minute / time.Millisecond)
+	lark_api, bot := newLarkStandIn(t, func(string) int { return 99991400 })
+	queue := &recordingQueue{MemoryQueue: mq.NewMemoryQueue(10)}
+	if err := queue.Produce(context.Background(), alertMessage(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newPool(queue, &mq.DLQ{}, newTestDelivery(bot, "oc_1"))
+	fetchCtx, stopFetch := context.WithCancel(context.Background())
+	deliverCtx, abort := context.WithCancel(context.Background())
+	go p.run(fetchCtx, deliverCtx)
+	<-lark_api.called
+
+	// stopping waits for the message in flight
+	stopFetch()
+	select {
+	case <-p.done:
+		t.Fatal("pool stopped before the message in flight was delivered or aborted")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	abort()
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("aborting did not stop the delivery waiting for its send retry")
+	}
+	if n := queue.Committed(); n != 0 {
+		t.Errorf("%d aborted messages were committed", n)
+	}
+	if calls := lark_api.Calls(); len(calls) != 1 {
+		t.Errorf("lark was called %d times, want 1: %v", len(calls), strings.Join(calls, ","))
+	}
+}
+
+// count returns how often chatID was sent to.
+func count(calls []string, chatID string) int {
+	n := 0
+	for _, p := range calls {
+		if p == chatID {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRetrySendsOnlyFailedCards(t *testing.T) {
+	cfg := setConfig(t)
+	cfg.Kafka.MaxDeliveryAttempts = 5
+	var mu sync.Mutex
+	failed := false
+	lark_api, bot := newLarkStandIn(t, func(chatID string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		if chatID == "oc_flaky" && !failed {
+			failed = true
+			return 99991400
+		}
+		return 0
+	})
+
+	delivery := newTestDelivery(bot, "oc_ok", "oc_flaky")
+	if !process(context.Background(), &mq.DLQ{}, delivery, alertMessage(t), func() {}) {
+		t.Fatal("message was not delivered")
+	}
+	calls := lark_api.Calls()
+	if count(calls, "oc_ok") != 1 || count(calls, "oc_flaky") != 2 {
+		t.Errorf("want one call for oc_ok and two for oc_flaky, got %v", calls)
+	}
+}
+
+func TestMaxAttemptsWithoutDLQ(t *testing.T) {
+	cfg := setConfig(t)
+	cfg.Kafka.MaxDeliveryAttempts = 2
+	lark_api, bot := newLarkStandIn(t, func(string) int { return 99991400 })
+
+	if !process(context.Background(), &mq.DLQ{}, newTestDelivery(bot, "oc_1"), alertMessage(t), func() {}) {
+		t.Fatal("undeliverable message was not dropped")
+	}
+	if calls := lark_api.Calls(); len(calls) != 2 {
+		t.Errorf("lark was called %d times, want 2", len(calls))
+	}
+}
+
+func TestPermanentErrorIsDeadLettered(t *testing.T) {
+	cfg := setConfig(t)
+	cfg.Lark.SendRetries = 3
+	cfg.Kafka.MaxDeliveryAttempts = 5
+	lark_api, bot := newLarkStandIn(t, func(chatID string) int {
+		if chatID == "oc_gone" {
+			// the bot is not in the chat
+			return 230002
+		}
+		return 0
+	})
+	dead := mq.NewMemoryQueue(10)
+	dlq := &mq.DLQ{Producer: dead, Topic: "dlq"}
+
+	start := time.Now()
+	if !process(context.Background(), dlq, newTestDelivery(bot, "oc_ok", "oc_gone"), alertMessage(t), func() {}) {
+		t.Fatal("message was not dead-lettered")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("permanent error was retried, processing took %s", elapsed)
+	}
+	calls := lark_api.Calls()
+	if count(calls, "oc_ok") != 1 || count(calls, "oc_gone") != 1 {
+		t.Errorf("want one call for each chat, got %v", calls)
+	}
+
+	letter, err := dead.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chatID := mq.HeaderValue(letter, mq.HeaderChatID); chatID != "oc_gone" {
+		t.Errorf("dead letter is for chat %q, want oc_gone", chatID)
+	}
+	if stage := mq.HeaderValue(letter, mq.HeaderDLQStage); stage != mq.StageDeliver {
+		t.Errorf("dead letter stage is %q", stage)
+	}
+	if n, _ := dead.Lag(context.Background()); n != 0 {
+		t.Errorf("%d more dead letters were published", n)
+	}
+}
+
+func TestBrokenMessageIsDeadLettered(t *testing.T) {
+	setConfig(t)
+	lark_api, bot := newLarkStandIn(t, func(string) int { return 0 })
+	dead := mq.NewMemoryQueue(10)
+	m := mq.Message{Value: []byte("not json"), Topic: "test"}
+
+	if !process(context.Background(), &mq.DLQ{Producer: dead, Topic: "dlq"}, newTestDelivery(bot, "oc_1"), m, func() {}) {
+		t.Fatal("broken message was retried")
+	}
+	letter, err := dead.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stage := mq.HeaderValue(letter, mq.HeaderDLQStage); stage != mq.StageDecode {
+		t.Errorf("dead letter stage is %q, want %s", stage, mq.StageDecode)
+	}
+	if calls := lark_api.Calls(); len(calls) != 0 {
+		t.Errorf("broken message was posted to %v", calls)
+	}
+}
+
+func TestStuckDeliveryFailsLiveness(t *testing.T) {
+	cfg := setConfig(t)
+	cfg.Health.StuckSeconds = 1
+	release := make(chan struct{})
+	lark_api, bot := newLarkStandIn(t, func(string) int {
+		<-release
+		return 0
+	})
+	queue := mq.NewMemoryQueue(10)
+	if err := queue.Produce(context.Background(), alertMessage(t)); err != nil {
+		t.Fatal(err)
+	}
+	registry := health.NewRegistry()
+	d := newTestDelivery(bot, "oc_1")
+	lc := fxtest.NewLifecycle(t)
+	Run(lc, queue, &mq.DLQ{}, d.Bot, d.Store, nil, d.Receivers, d.Templates, registry)
+	lc.RequireStart()
+	defer lc.RequireStop()
+	defer close(release)
+
+	<-lark_api.called
+	if report := registry.Live(context.Background()); report.Status != health.StatusOK {
+		t.Errorf("worker is reported stuck right away: %+v", report)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	report := registry.Live(context.Background())
+	if c := report.Components["consumer"]; report.Status != health.StatusError || !strings.Contains(c.Error, "stuck") {
+		t.Errorf("stuck worker is reported as %+v", report)
+	}
+}
+
+func TestFailedUpdateIsRetried(t *testing.T) {
+	tests := []struct {
+		name string
+		// code is the lark error code of the update
+		code      int
+		wantErr   bool
+		wantCalls int
+	}{
+		{name: "transient", code: 99991400, wantErr: true, wantCalls: 1},
+		{name: "message deleted", code: 230110, wantCalls: 2},
+		{name: "message recalled", code: 230011, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t)
+			var mu sync.Mutex
+			updated := false
+			lark_api, bot := newLarkStandIn(t, func(string) int {
+				mu.Lock()
+				defer mu.Unlock()
+				if !updated {
+					updated = true
+					return tt.code
+				}
+				return 0
+			})
+			delivery := newTestDelivery(bot, "oc_1")
+			prev := &state.Entry{ChatID: "oc_1", MessageID: "om_old"}
+			delivery.Store.Put("k", prev)
+
+			err := delivery.deliver(context.Background(), "k", prev, &state.Entry{ChatID: "oc_1"}, "{}")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("deliver error = %v, want error %v", err, tt.wantErr)
+			}
+			if calls := lark_api.Calls(); len(calls) != tt.wantCalls {
+				t.Errorf("lark was called %v, want %d calls", calls, tt.wantCalls)
+			}
+			e, _, _ := delivery.Store.Get("k")
+			want := "om_old"
+			if !tt.wantErr {
+				want = "om_oc_1"
+			}
+			if e.MessageID != want {
+				t.Errorf("message id is %s, want %s", e.MessageID, want)
+			}
+		})
+	}
+}